@@ -0,0 +1,161 @@
+// Package api serves the data stored by the processors over HTTP, hiding
+// the backend (MongoDB, Redis or PostgreSQL) each one writes to.
+//
+// All endpoints answer JSON, results are wrapped in a `data` field and
+// errors in an `error` one. Times are RFC 3339 in UTC, periods of top and
+// users queries are in the reporting timezone of the distinctname processor.
+//
+//	GET /api/v1/events?username=&metric=&from=&to=&limit=
+//	GET /api/v1/top?hour=2006-01-02T15&n=&mode=
+//	GET /api/v1/top?day=2006-01-02&n=&mode=
+//	GET /api/v1/top?month=2006-01&n=&mode=
+//	GET /api/v1/top?year=2006&n=&mode=
+//	GET /api/v1/users?month=2006-01&metric=&limit=
+//	GET /api/v1/accounts?username=&from=&to=&limit=
+package api
+
+import (
+	"time"
+)
+
+// Limits of the number of results returned
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+	DefaultTopN  = 10
+)
+
+// Event stored by the hourlylog processor
+type Event struct {
+	Username string            `json:"username"`
+	Metric   string            `json:"metric"`
+	Count    int64             `json:"count"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	Time     time.Time         `json:"time"`
+}
+
+// EventQuery filters events, zero fields match all of them
+type EventQuery struct {
+	Username string
+	Metric   string
+	From     time.Time
+	To       time.Time
+	Limit    int
+}
+
+// EventReader returns the latest events matching a query, newest first
+type EventReader interface {
+	Events(q EventQuery) ([]Event, error)
+}
+
+// Period of time distinct metrics are counted in
+type Period int
+
+// Periods
+const (
+	Hour Period = iota
+	Day
+	Month
+	Year
+)
+
+var periodNames = [...]string{"hour", "day", "month", "year"}
+
+func (p Period) String() string {
+	return periodNames[p]
+}
+
+// Mode metrics are counted in by the distinctname processor
+type Mode int
+
+// Modes
+const (
+	// Count occurrences
+	Count Mode = iota
+	// Sum the count of the events
+	Sum
+	// Max count of the events
+	Max
+	// Min count of the events
+	Min
+)
+
+var modeNames = [...]string{"count", "sum", "max", "min"}
+
+func (m Mode) String() string {
+	return modeNames[m]
+}
+
+// MetricCount is the number of occurrences of a metric in a period, or the
+// sum, max or min of their count depending on the mode queried
+type MetricCount struct {
+	Metric string `json:"metric"`
+	Count  int64  `json:"count"`
+}
+
+// TopQuery selects the N metrics with the highest count in the period
+// containing Time, counted in Mode
+type TopQuery struct {
+	Period Period
+	Time   time.Time
+	N      int
+	Mode   Mode
+}
+
+// TopReader returns the metrics matching a query, highest count first, as
+// counted by the distinctname processor. It returns ErrUnsupported for
+// periods or modes it doesn't keep
+type TopReader interface {
+	Top(q TopQuery) ([]MetricCount, error)
+}
+
+// UserCount is the estimated number of unique users of a metric in a period
+type UserCount struct {
+	Metric string `json:"metric"`
+	Users  int64  `json:"users"`
+}
+
+// UsersQuery selects the metrics (all if empty) of the period containing Time
+// to count the unique users of
+type UsersQuery struct {
+	Period  Period
+	Time    time.Time
+	Metrics []string
+	Limit   int
+}
+
+// UsersReader returns the unique users of the metrics matching a query, most
+// users first, as estimated by the distinctname processor. It returns
+// ErrUnsupported if it doesn't count them
+type UsersReader interface {
+	Users(q UsersQuery) ([]UserCount, error)
+}
+
+// Account and the first time it sent a metric, as stored by the accountname
+// processor
+type Account struct {
+	Username  string    `json:"username"`
+	FirstSeen time.Time `json:"first_seen"`
+}
+
+// ErrUnsupported is returned by readers for queries they can't answer, ie. a
+// period they don't keep
+type ErrUnsupported string
+
+func (e ErrUnsupported) Error() string {
+	return string(e)
+}
+
+// AccountQuery filters accounts, by username or first seen time. Zero fields
+// match all of them
+type AccountQuery struct {
+	Usernames []string
+	From      time.Time
+	To        time.Time
+	Limit     int
+}
+
+// AccountReader returns the accounts matching a query, oldest first
+type AccountReader interface {
+	Accounts(q AccountQuery) ([]Account, error)
+}
@@ -0,0 +1,267 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/exekias/metric-collector/logging"
+)
+
+var log = logging.MustGetLogger("api")
+
+// Server answers queries using the given readers, nil ones make their
+// endpoint fail with 503 Service Unavailable
+type Server struct {
+	Events   EventReader
+	Top      TopReader
+	Users    UsersReader
+	Accounts AccountReader
+
+	// Location days and months in top and users queries are given in, the
+	// reporting timezone of Top and Users. UTC if nil
+	Location *time.Location
+}
+
+// Register the API endpoints in mux
+func (s *Server) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/events", get(s.events))
+	mux.HandleFunc("/api/v1/top", get(s.top))
+	mux.HandleFunc("/api/v1/users", get(s.users))
+	mux.HandleFunc("/api/v1/accounts", get(s.accounts))
+}
+
+// badRequest is an error in the query parameters
+type badRequest string
+
+func (e badRequest) Error() string {
+	return string(e)
+}
+
+// errUnavailable is returned when the backend for an endpoint is not set
+type errUnavailable string
+
+func (e errUnavailable) Error() string {
+	return fmt.Sprintf("%s are not available, run serve with the %s processor", string(e), processorFor[string(e)])
+}
+
+var processorFor = map[string]string{
+	"events":   "hourlylog",
+	"top":      "distinctname",
+	"users":    "distinctname",
+	"accounts": "accountname",
+}
+
+// get wraps a query, encoding its result or error
+func get(query func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "Method not allowed"})
+			return
+		}
+
+		data, err := query(r)
+		switch err.(type) {
+		case nil:
+			writeJSON(w, http.StatusOK, map[string]interface{}{"data": data})
+		case badRequest:
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		case ErrUnsupported:
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		case errUnavailable:
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+		default:
+			log.Errorf("Error answering %s: %s", r.URL, err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Backend error"})
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) events(r *http.Request) (interface{}, error) {
+	if s.Events == nil {
+		return nil, errUnavailable("events")
+	}
+
+	q := EventQuery{
+		Username: r.FormValue("username"),
+		Metric:   r.FormValue("metric"),
+	}
+	var err error
+	if q.From, q.To, err = timeRange(r); err != nil {
+		return nil, err
+	}
+	if q.Limit, err = intParam(r, "limit", DefaultLimit, MaxLimit); err != nil {
+		return nil, err
+	}
+
+	events, err := s.Events.Events(q)
+	if events == nil {
+		events = []Event{}
+	}
+	return events, err
+}
+
+func (s *Server) top(r *http.Request) (interface{}, error) {
+	if s.Top == nil {
+		return nil, errUnavailable("top")
+	}
+
+	period, t, err := s.period(r)
+	if err != nil {
+		return nil, err
+	}
+	n, err := intParam(r, "n", DefaultTopN, MaxLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	mode := Count
+	if v := r.FormValue("mode"); v != "" {
+		found := false
+		for m, name := range modeNames {
+			if name == v {
+				mode, found = Mode(m), true
+			}
+		}
+		if !found {
+			return nil, badRequest("Invalid mode, expected count, sum, max or min")
+		}
+	}
+
+	top, err := s.Top.Top(TopQuery{Period: period, Time: t, N: n, Mode: mode})
+	if top == nil {
+		top = []MetricCount{}
+	}
+	return top, err
+}
+
+func (s *Server) users(r *http.Request) (interface{}, error) {
+	if s.Users == nil {
+		return nil, errUnavailable("users")
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return nil, badRequest(err.Error())
+	}
+	q := UsersQuery{Metrics: r.Form["metric"]}
+	var err error
+	if q.Period, q.Time, err = s.period(r); err != nil {
+		return nil, err
+	}
+	if q.Limit, err = intParam(r, "limit", DefaultLimit, MaxLimit); err != nil {
+		return nil, err
+	}
+
+	users, err := s.Users.Users(q)
+	if users == nil {
+		users = []UserCount{}
+	}
+	return users, err
+}
+
+// period returns the period given by the hour, day, month or year parameter
+// of r, and a time in it. Today if none
+func (s *Server) period(r *http.Request) (Period, time.Time, error) {
+	loc := s.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	period, t := Day, time.Now().In(loc)
+	given := 0
+	for p, layout := range periodLayouts {
+		v := r.FormValue(p.String())
+		if v == "" {
+			continue
+		}
+		given++
+		var err error
+		if t, err = time.ParseInLocation(layout, v, loc); err != nil {
+			return period, t, badRequest(fmt.Sprintf("Invalid %s, expected %s", p, periodFormats[p]))
+		}
+		period = p
+	}
+	if given > 1 {
+		return period, t, badRequest("Expected only one of hour, day, month or year")
+	}
+	return period, t, nil
+}
+
+// periodLayouts parse the period parameter of each period
+var periodLayouts = map[Period]string{
+	Hour:  "2006-01-02T15",
+	Day:   "2006-01-02",
+	Month: "2006-01",
+	Year:  "2006",
+}
+
+var periodFormats = map[Period]string{
+	Hour:  "YYYY-MM-DDTHH",
+	Day:   "YYYY-MM-DD",
+	Month: "YYYY-MM",
+	Year:  "YYYY",
+}
+
+func (s *Server) accounts(r *http.Request) (interface{}, error) {
+	if s.Accounts == nil {
+		return nil, errUnavailable("accounts")
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return nil, badRequest(err.Error())
+	}
+	q := AccountQuery{Usernames: r.Form["username"]}
+	var err error
+	if q.From, q.To, err = timeRange(r); err != nil {
+		return nil, err
+	}
+	if q.Limit, err = intParam(r, "limit", DefaultLimit, MaxLimit); err != nil {
+		return nil, err
+	}
+
+	accounts, err := s.Accounts.Accounts(q)
+	if accounts == nil {
+		accounts = []Account{}
+	}
+	return accounts, err
+}
+
+// timeRange returns the from and to parameters, zero if not given
+func timeRange(r *http.Request) (from, to time.Time, err error) {
+	if v := r.FormValue("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, badRequest("Invalid from, expected an RFC 3339 time")
+		}
+	}
+	if v := r.FormValue("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, badRequest("Invalid to, expected an RFC 3339 time")
+		}
+	}
+	if !from.IsZero() && !to.IsZero() && to.Before(from) {
+		return from, to, badRequest("Invalid range, to is before from")
+	}
+	return from.UTC(), to.UTC(), nil
+}
+
+// intParam returns the positive integer parameter with the given name, or
+// def if not given
+func intParam(r *http.Request, name string, def, max int) (int, error) {
+	v := r.FormValue(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > max {
+		return 0, badRequest(fmt.Sprintf("Invalid %s, expected a number between 1 and %d", name, max))
+	}
+	return n, nil
+}
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type fakeReader struct {
+	events   EventQuery
+	top      TopQuery
+	users    UsersQuery
+	accounts AccountQuery
+	err      error
+}
+
+func (f *fakeReader) Events(q EventQuery) ([]Event, error) {
+	f.events = q
+	return []Event{{Username: "user1", Metric: "metric1", Count: 1, Time: q.From}}, f.err
+}
+
+func (f *fakeReader) Top(q TopQuery) ([]MetricCount, error) {
+	f.top = q
+	return []MetricCount{{Metric: "metric1", Count: 3}}, f.err
+}
+
+func (f *fakeReader) Users(q UsersQuery) ([]UserCount, error) {
+	f.users = q
+	return []UserCount{{Metric: "metric1", Users: 42}}, f.err
+}
+
+func (f *fakeReader) Accounts(q AccountQuery) ([]Account, error) {
+	f.accounts = q
+	return nil, f.err
+}
+
+func serve(s *Server, url string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	s.Register(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+	return rec
+}
+
+func TestEvents(t *testing.T) {
+	f := &fakeReader{}
+	rec := serve(&Server{Events: f}, "/api/v1/events?username=user1&from=2016-05-04T10:00:00Z&limit=5")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+
+	from := time.Date(2016, 5, 4, 10, 0, 0, 0, time.UTC)
+	expected := EventQuery{Username: "user1", From: from, Limit: 5}
+	if !reflect.DeepEqual(f.events, expected) {
+		t.Errorf("Expected query %+v, got %+v", expected, f.events)
+	}
+
+	var res struct{ Data []Event }
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Data) != 1 || res.Data[0].Username != "user1" || !res.Data[0].Time.Equal(from) {
+		t.Errorf("Unexpected events: %+v", res.Data)
+	}
+}
+
+func TestTop(t *testing.T) {
+	f := &fakeReader{}
+	rec := serve(&Server{Top: f}, "/api/v1/top?month=2016-05")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	q := f.top
+	if q.Period != Month || q.Time.Month() != time.May || q.N != DefaultTopN || q.Mode != Count {
+		t.Errorf("Unexpected query: %+v", q)
+	}
+	if body := rec.Body.String(); body != `{"data":[{"metric":"metric1","count":3}]}`+"\n" {
+		t.Errorf("Unexpected body: %s", body)
+	}
+
+	serve(&Server{Top: f}, "/api/v1/top?day=2016-05-04&mode=max")
+	if f.top.Period != Day || f.top.Mode != Max {
+		t.Errorf("Unexpected query: %+v", f.top)
+	}
+}
+
+func TestUsers(t *testing.T) {
+	f := &fakeReader{}
+	rec := serve(&Server{Users: f}, "/api/v1/users?month=2016-05&metric=metric1&metric=metric2")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	q := f.users
+	if q.Period != Month || q.Time.Month() != time.May || q.Limit != DefaultLimit || !reflect.DeepEqual(q.Metrics, []string{"metric1", "metric2"}) {
+		t.Errorf("Unexpected query: %+v", q)
+	}
+	if body := rec.Body.String(); body != `{"data":[{"metric":"metric1","users":42}]}`+"\n" {
+		t.Errorf("Unexpected body: %s", body)
+	}
+}
+
+func TestAccountsEmpty(t *testing.T) {
+	f := &fakeReader{}
+	rec := serve(&Server{Accounts: f}, "/api/v1/accounts?username=a&username=b")
+	if !reflect.DeepEqual(f.accounts.Usernames, []string{"a", "b"}) {
+		t.Errorf("Expected both usernames, got %v", f.accounts.Usernames)
+	}
+	if body := rec.Body.String(); body != `{"data":[]}`+"\n" {
+		t.Errorf("Expected an empty list, got %s", body)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	failing := &fakeReader{err: errors.New("connection refused")}
+	for url, code := range map[string]int{
+		"/api/v1/events?limit=0":                                             http.StatusBadRequest,
+		"/api/v1/events?from=yesterday":                                      http.StatusBadRequest,
+		"/api/v1/top?day=2016-05-04&month=2016-05":                           http.StatusBadRequest,
+		"/api/v1/top?mode=avg":                                               http.StatusBadRequest,
+		"/api/v1/accounts?from=2016-05-04T10:00:00Z&to=2016-05-03T10:00:00Z": http.StatusBadRequest,
+	} {
+		if rec := serve(&Server{Events: &fakeReader{}, Top: &fakeReader{}, Accounts: &fakeReader{}}, url); rec.Code != code {
+			t.Errorf("Expected %d for %s, got %d: %s", code, url, rec.Code, rec.Body)
+		}
+	}
+
+	rec := serve(&Server{}, "/api/v1/top")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 without backend, got %d", rec.Code)
+	}
+
+	rec = serve(&Server{Events: failing}, "/api/v1/events")
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 on backend errors, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,170 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/exekias/metric-collector/constants"
+	"github.com/exekias/metric-collector/workers"
+)
+
+func init() {
+	workers.Register("test_config", workers.Factory{
+		Queue:    constants.Queue{Name: "testConfig"},
+		Settings: []workers.Setting{{Name: "TEST_CONFIG_URL"}},
+		New: func(c workers.Config) (workers.MetricDataProcessor, error) {
+			return nil, nil
+		},
+	})
+}
+
+func load(t *testing.T, data string) *Config {
+	f, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(data)
+	f.Close()
+
+	c, err := Load(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestLoadOverridesDefaults(t *testing.T) {
+	os.Setenv("LOG_LEVEL", "debug")
+	defer os.Unsetenv("LOG_LEVEL")
+
+	c := load(t, `
+worker:
+  drain_timeout: 10s
+queues:
+  test_config:
+    bindings: ["kite.#"]
+processors:
+  test_config:
+    test_config_url: localhost
+log:
+  level: error
+`)
+
+	if c.Worker.DrainTimeout != 10*time.Second {
+		t.Errorf("Expected drain timeout 10s, got %s", c.Worker.DrainTimeout)
+	}
+	if c.Worker.MaxAttempts != workers.DefaultOptions.MaxAttempts {
+		t.Errorf("Expected default max attempts, got %d", c.Worker.MaxAttempts)
+	}
+	if c.Log.Level != "debug" {
+		t.Errorf("Expected $LOG_LEVEL to override the file, got %s", c.Log.Level)
+	}
+
+	factory, _ := workers.Lookup("test_config")
+	queue, bindings := c.Queue("test_config", factory.Queue)
+	if queue != "testConfig" || len(bindings) != 1 || bindings[0] != "kite.#" {
+		t.Errorf("Unexpected queue %s bound with %v", queue, bindings)
+	}
+
+	if err := c.Validate("test_config"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTransientQueuePerInstance(t *testing.T) {
+	c := load(t, "")
+	queue, _ := c.Queue("test_transient", constants.Queue{Name: "testTransient", Transient: true})
+	hostname, _ := os.Hostname()
+	if queue != "testTransient."+hostname+"-"+strconv.Itoa(os.Getpid()) {
+		t.Errorf("Expected a queue for this instance, got %s", queue)
+	}
+}
+
+func TestValidateListsErrors(t *testing.T) {
+	c := load(t, `
+broker:
+  url: http://localhost
+exchange:
+  type: headers
+processors:
+  test_config:
+    unknown: value
+worker:
+  max_attempts: -1
+log:
+  level: verbose
+  format: xml
+  modules:
+    queue: loud
+`)
+
+	err := c.Validate("test_config")
+	errs, ok := err.(Errors)
+	if !ok {
+		t.Fatalf("Expected validation errors, got %v", err)
+	}
+
+	for _, field := range []string{"broker.url", "exchange.type", "log.level", "log.format", "log.modules.queue", "processors.test_config.unknown", "processors.test_config: Missing settings: test_config_url", "worker.max_attempts"} {
+		found := false
+		for _, e := range errs {
+			if strings.HasPrefix(e, field) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Expected an error for %s in:\n%s", field, err)
+		}
+	}
+}
+
+func TestValidateDirectExchangeBindings(t *testing.T) {
+	c := load(t, `
+exchange:
+  type: direct
+`)
+	if err := c.Validate("test_config"); err == nil || !strings.Contains(err.Error(), "queues.test_config.bindings") {
+		t.Errorf("Expected an error for missing bindings, got %v", err)
+	}
+
+	c = load(t, `
+exchange:
+  type: direct
+queues:
+  test_config:
+    bindings: ["kite.call"]
+`)
+	if err := c.Validate("test_config"); err != nil && strings.Contains(err.Error(), "bindings") {
+		t.Errorf("Unexpected bindings error: %s", err)
+	}
+}
+
+func TestValidateUnlinkedProcessors(t *testing.T) {
+	// Processors are not linked in this test, as in the dispatcher
+	c := load(t, `
+queues:
+  hourlylog:
+    bindings: ["kite.#"]
+processors:
+  topk:
+    topk_k: 10
+`)
+	if err := c.Validate(); err != nil {
+		t.Errorf("Expected processors in constants.Queues to be known, got %s", err)
+	}
+}
+
+func TestLoadRejectsUnknownFields(t *testing.T) {
+	f, _ := ioutil.TempFile("", "config")
+	defer os.Remove(f.Name())
+	f.WriteString("brokr:\n  url: amqp://localhost\n")
+	f.Close()
+
+	if _, err := Load(f.Name()); err == nil {
+		t.Error("Expected an error for an unknown field")
+	}
+}
@@ -1,8 +1,13 @@
 package constants
 
 const (
-	// Exchange name
-	Exchange = "metric_collector"
+	// Exchange name, metrics are routed by name (see queue.RoutingKey)
+	// Previous versions used a fanout exchange named "metric_collector",
+	// existing queues keep their bindings to it so old producers still work
+	Exchange = "metric_collector.topic"
+
+	// ExchangeType of Exchange
+	ExchangeType = "topic"
 
 	// DistinctName metric queue
 	DistinctName = "distinctName"
@@ -12,7 +17,31 @@ const (
 
 	// AccountName metric queue
 	AccountName = "accountName"
+
+	// TopK metric queue
+	TopK = "topK"
 )
 
-// Queues supported
-var Queues = [...]string{DistinctName, HourlyLog, AccountName}
+// Queue consumed by a processor
+type Queue struct {
+	// Name of the queue
+	Name string
+
+	// Bindings to the exchange, all metrics if empty. For instance
+	// []string{"kite.#"} would only deliver metrics starting with `kite_`
+	Bindings []string
+
+	// Transient processors only need the metrics sent while they run. Each
+	// instance consumes its own queue, which is not durable and only declared
+	// by the workers running them, so it's deleted once they stop
+	Transient bool
+}
+
+// Queues by processor name. They are kept here, apart from the processors,
+// so the dispatcher can declare them without linking their backend drivers
+var Queues = map[string]Queue{
+	"accountname":  {Name: AccountName},
+	"distinctname": {Name: DistinctName},
+	"hourlylog":    {Name: HourlyLog},
+	"topk":         {Name: TopK, Transient: true},
+}
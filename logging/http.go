@@ -0,0 +1,33 @@
+package logging
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Handler serves the level of each module, changing it on POST or PUT with
+// `module` (empty for the default level) and `level` parameters, ie.
+// `curl -X PUT 'localhost:8080/debug/log?module=queue&level=debug'`
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+		case "POST", "PUT":
+			level, err := ParseLevel(r.FormValue("level"))
+			if err != nil {
+				http.Error(w, "Invalid level, expected debug, info, notice, warning, error or critical", http.StatusBadRequest)
+				return
+			}
+			module := r.FormValue("module")
+			SetLevel(level, module)
+			MustGetLogger("logging").Noticef("Log level for module '%s' set to %s", module, level)
+		default:
+			w.Header().Set("Allow", "GET, POST, PUT")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Levels())
+	})
+}
@@ -1,27 +1,318 @@
 package logging
 
-import glogging "github.com/op/go-logging"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	glogging "github.com/op/go-logging"
+)
 
 const (
 	// DEBUG level
 	DEBUG = glogging.DEBUG
 )
 
+// Output formats
+const (
+	// Text is a colored line per message, fields are appended as key=value
+	Text = "text"
+
+	// JSON is a JSON object per line, fields are added as keys
+	JSON = "json"
+)
+
 var format = glogging.MustStringFormatter(
 	`%{color}%{shortfunc} - %{level:5s} %{id:03x}%{color:reset} %{message}`,
 )
 
+// output settings
+var output = struct {
+	sync.Mutex
+	format string
+	writer io.Writer
+}{format: Text, writer: os.Stderr}
+
+// modules with a logger, by name
+var modules = struct {
+	sync.Mutex
+	names map[string]bool
+}{names: make(map[string]bool)}
+
+// levels of each module, "" is the default one. go-logging doesn't lock its
+// own levels, so they can't change while logging: they are kept here and
+// go-logging lets every message through
+var levels = struct {
+	sync.RWMutex
+	modules map[string]glogging.Level
+}{modules: map[string]glogging.Level{"": glogging.INFO}}
+
 func init() {
 	glogging.SetFormatter(format)
-	glogging.SetLevel(glogging.INFO, "")
+	glogging.SetLevel(glogging.DEBUG, "")
+}
+
+// Fields give context to log messages, ie. the queue or metric being processed
+type Fields map[string]interface{}
+
+// Logger for a module, optionally carrying fields added to all its messages
+type Logger struct {
+	module string
+	base   *glogging.Logger
+	fields Fields
 }
 
 // MustGetLogger returns a logger instance for the given module name
-func MustGetLogger(module string) *glogging.Logger {
-	return glogging.MustGetLogger(module)
+func MustGetLogger(module string) *Logger {
+	base := glogging.MustGetLogger(module)
+	// Skip Logger frames, so messages show the right caller
+	base.ExtraCalldepth = 3
+
+	modules.Lock()
+	modules.names[module] = true
+	modules.Unlock()
+
+	return &Logger{module: module, base: base}
+}
+
+// With returns a logger adding the given fields to its messages, besides
+// the ones in l
+func (l *Logger) With(fields Fields) *Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{module: l.module, base: l.base, fields: merged}
+}
+
+// Debugf logs a message at debug level, formatted with fmt.Sprintf
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(glogging.DEBUG, format, args)
+}
+
+// Infof logs a message at info level, formatted with fmt.Sprintf
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(glogging.INFO, format, args)
+}
+
+// Noticef logs a message at notice level, formatted with fmt.Sprintf
+func (l *Logger) Noticef(format string, args ...interface{}) {
+	l.logf(glogging.NOTICE, format, args)
+}
+
+// Warningf logs a message at warning level, formatted with fmt.Sprintf
+func (l *Logger) Warningf(format string, args ...interface{}) {
+	l.logf(glogging.WARNING, format, args)
+}
+
+// Errorf logs a message at error level, formatted with fmt.Sprintf
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(glogging.ERROR, format, args)
+}
+
+// Criticalf logs a message at critical level, formatted with fmt.Sprintf
+func (l *Logger) Criticalf(format string, args ...interface{}) {
+	l.logf(glogging.CRITICAL, format, args)
+}
+
+// Fatalf logs a message at critical level and exits
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.logf(glogging.CRITICAL, format, args)
+	os.Exit(1)
+}
+
+// Debug logs its arguments at debug level, separated by spaces
+func (l *Logger) Debug(args ...interface{}) {
+	l.log(glogging.DEBUG, args)
+}
+
+// Info logs its arguments at info level, separated by spaces
+func (l *Logger) Info(args ...interface{}) {
+	l.log(glogging.INFO, args)
+}
+
+// Notice logs its arguments at notice level, separated by spaces
+func (l *Logger) Notice(args ...interface{}) {
+	l.log(glogging.NOTICE, args)
 }
 
-// SetLevel for logging
+// Warning logs its arguments at warning level, separated by spaces
+func (l *Logger) Warning(args ...interface{}) {
+	l.log(glogging.WARNING, args)
+}
+
+// Error logs its arguments at error level, separated by spaces
+func (l *Logger) Error(args ...interface{}) {
+	l.log(glogging.ERROR, args)
+}
+
+// Critical logs its arguments at critical level, separated by spaces
+func (l *Logger) Critical(args ...interface{}) {
+	l.log(glogging.CRITICAL, args)
+}
+
+// Fatal logs its arguments at critical level and exits
+func (l *Logger) Fatal(args ...interface{}) {
+	l.log(glogging.CRITICAL, args)
+	os.Exit(1)
+}
+
+func (l *Logger) logf(level glogging.Level, format string, args []interface{}) {
+	if !isEnabledFor(level, l.module) {
+		return
+	}
+	l.write(level, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) log(level glogging.Level, args []interface{}) {
+	if !isEnabledFor(level, l.module) {
+		return
+	}
+	msg := fmt.Sprintln(args...)
+	l.write(level, msg[:len(msg)-1])
+}
+
+// write the message in the configured format
+func (l *Logger) write(level glogging.Level, msg string) {
+	output.Lock()
+	f, w := output.format, output.writer
+	output.Unlock()
+
+	if f == JSON {
+		l.writeJSON(w, level, msg)
+		return
+	}
+
+	if len(l.fields) > 0 {
+		msg += " " + l.fields.String()
+	}
+	switch level {
+	case glogging.DEBUG:
+		l.base.Debug(msg)
+	case glogging.INFO:
+		l.base.Info(msg)
+	case glogging.NOTICE:
+		l.base.Notice(msg)
+	case glogging.WARNING:
+		l.base.Warning(msg)
+	case glogging.ERROR:
+		l.base.Error(msg)
+	default:
+		l.base.Critical(msg)
+	}
+}
+
+func (l *Logger) writeJSON(w io.Writer, level glogging.Level, msg string) {
+	record := make(map[string]interface{}, len(l.fields)+4)
+	for k, v := range l.fields {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		record[k] = v
+	}
+	record["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	record["level"] = level.String()
+	record["module"] = l.module
+	record["message"] = msg
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		line, _ = json.Marshal(map[string]string{
+			"time":    record["time"].(string),
+			"level":   level.String(),
+			"module":  l.module,
+			"message": fmt.Sprintf("%s (could not encode fields: %s)", msg, err),
+		})
+	}
+
+	output.Lock()
+	w.Write(append(line, '\n'))
+	output.Unlock()
+}
+
+// String returns the fields as sorted key=value pairs
+func (f Fields) String() string {
+	keys := make([]string, 0, len(f))
+	for k := range f {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		value := fmt.Sprint(f[k])
+		if strings.ContainsAny(value, " \"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		pairs[i] = k + "=" + value
+	}
+	return strings.Join(pairs, " ")
+}
+
+// SetFormat of log messages, Text (default) or JSON
+func SetFormat(format string) error {
+	if format != Text && format != JSON {
+		return fmt.Errorf("Unknown log format '%s', expected text or json", format)
+	}
+	output.Lock()
+	output.format = format
+	output.Unlock()
+	return nil
+}
+
+// SetOutput sets where messages in JSON format are written, stderr by default
+func SetOutput(w io.Writer) {
+	output.Lock()
+	output.writer = w
+	output.Unlock()
+}
+
+// SetLevel for logging, "" module sets the default level. It is safe to
+// call while logging
 func SetLevel(level glogging.Level, module string) {
-	glogging.SetLevel(level, module)
+	levels.Lock()
+	levels.modules[module] = level
+	levels.Unlock()
+}
+
+// getLevel returns the level of module, the default one if it has none
+func getLevel(module string) glogging.Level {
+	levels.RLock()
+	defer levels.RUnlock()
+	if level, ok := levels.modules[module]; ok {
+		return level
+	}
+	return levels.modules[""]
+}
+
+func isEnabledFor(level glogging.Level, module string) bool {
+	return level <= getLevel(module)
+}
+
+// ParseLevel returns the level with the given name (ie. debug, info, warning)
+func ParseLevel(name string) (glogging.Level, error) {
+	if name == "" {
+		return glogging.ERROR, errors.New("Empty log level")
+	}
+	return glogging.LogLevel(name)
+}
+
+// Levels returns the current level of every module, "" is the default one
+func Levels() map[string]string {
+	modules.Lock()
+	defer modules.Unlock()
+	current := map[string]string{"": getLevel("").String()}
+	for module := range modules.names {
+		current[module] = getLevel(module).String()
+	}
+	return current
 }
@@ -0,0 +1,103 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	glogging "github.com/op/go-logging"
+)
+
+func TestJSONFormat(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	SetFormat(JSON)
+	defer SetFormat(Text)
+
+	log := MustGetLogger("test_json").With(Fields{"queue": "q", "delivery_tag": 7})
+	log.With(Fields{"error": errors.New("boom")}).Warningf("Could not process %s", "metric")
+	log.Debug("Hidden at the default level")
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Expected a single JSON line, got %q: %s", buf.String(), err)
+	}
+	expected := map[string]interface{}{
+		"level":        "WARNING",
+		"module":       "test_json",
+		"message":      "Could not process metric",
+		"queue":        "q",
+		"delivery_tag": 7.0,
+		"error":        "boom",
+	}
+	for k, v := range expected {
+		if record[k] != v {
+			t.Errorf("Expected %s to be %v, got %v", k, v, record[k])
+		}
+	}
+	if _, ok := record["time"]; !ok {
+		t.Error("Expected a time field")
+	}
+}
+
+func TestFieldsString(t *testing.T) {
+	f := Fields{"queue": "q", "latency": 0.5, "username": "john doe"}
+	if s := f.String(); s != `latency=0.5 queue=q username="john doe"` {
+		t.Errorf("Unexpected fields string: %s", s)
+	}
+}
+
+func TestHandlerSetsLevel(t *testing.T) {
+	MustGetLogger("test_handler")
+	defer SetLevel(glogging.INFO, "test_handler")
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("PUT", "/debug/log?module=test_handler&level=debug", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+
+	var levels map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &levels); err != nil {
+		t.Fatal(err)
+	}
+	if levels["test_handler"] != "DEBUG" {
+		t.Errorf("Expected DEBUG level, got %v", levels)
+	}
+
+	rec = httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("PUT", "/debug/log?module=test_handler&level=loud", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown level, got %d", rec.Code)
+	}
+}
+
+func TestSetLevelWhileLogging(t *testing.T) {
+	SetOutput(ioutil.Discard)
+	SetFormat(JSON)
+	defer SetFormat(Text)
+	defer SetLevel(glogging.INFO, "test_concurrent")
+
+	log := MustGetLogger("test_concurrent")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			log.Debugf("Message %d", i)
+		}
+	}()
+
+	handler := Handler()
+	for _, level := range []string{"debug", "info", "warning", "debug"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("PUT", "/debug/log?module=test_concurrent&level="+level, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("Expected 200, got %d: %s", rec.Code, rec.Body)
+		}
+	}
+	<-done
+}
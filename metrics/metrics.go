@@ -0,0 +1,135 @@
+// Package metrics serves metrics in the Prometheus text exposition format
+// Packages register collectors writing their metric families on each scrape
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Namespace prefixed to all metric names
+const Namespace = "metric_collector"
+
+// Metric types
+const (
+	Counter   = "counter"
+	Gauge     = "gauge"
+	Histogram = "histogram"
+)
+
+// Collector writes metric families on each scrape
+type Collector func(w *Writer)
+
+var collectors struct {
+	sync.Mutex
+	list []Collector
+}
+
+// Register a collector, usually from package init
+func Register(c Collector) {
+	collectors.Lock()
+	collectors.list = append(collectors.list, c)
+	collectors.Unlock()
+}
+
+// Handler serves the metrics from all registered collectors
+func Handler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		w := &Writer{}
+		collectors.Lock()
+		for _, c := range collectors.list {
+			c(w)
+		}
+		collectors.Unlock()
+
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		rw.Write(w.buf.Bytes())
+	})
+}
+
+// Labels of a sample
+type Labels map[string]string
+
+// Writer writes metric families, all samples of a family must be written
+// right after it
+type Writer struct {
+	buf bytes.Buffer
+}
+
+// Family starts a metric family with the given name (without namespace)
+func (w *Writer) Family(name, kind, help string) {
+	fmt.Fprintf(&w.buf, "# HELP %s_%s %s\n", Namespace, name, help)
+	fmt.Fprintf(&w.buf, "# TYPE %s_%s %s\n", Namespace, name, kind)
+}
+
+// Sample writes a sample of the current family
+func (w *Writer) Sample(name string, labels Labels, value float64) {
+	fmt.Fprintf(&w.buf, "%s_%s%s %s\n", Namespace, name, formatLabels(labels), formatValue(value))
+}
+
+// Histogram writes the samples of a histogram given its bucket upper bounds
+// and (non cumulative) counts, with an extra count for the +Inf bucket
+func (w *Writer) Histogram(name string, labels Labels, bounds []float64, counts []int64, sum float64) {
+	var total int64
+	for i, count := range counts {
+		total += count
+		le := "+Inf"
+		if i < len(bounds) {
+			le = formatValue(bounds[i])
+		}
+		w.Sample(name+"_bucket", with(labels, "le", le), float64(total))
+	}
+	w.Sample(name+"_sum", labels, sum)
+	w.Sample(name+"_count", labels, float64(total))
+}
+
+// with returns a copy of labels with the given one added
+func with(labels Labels, name, value string) Labels {
+	res := Labels{name: value}
+	for k, v := range labels {
+		res[k] = v
+	}
+	return res
+}
+
+func formatLabels(labels Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", name, escape(labels[name]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(value string) string {
+	return escaper.Replace(value)
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,31 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandlerWritesFamilies(t *testing.T) {
+	Register(func(w *Writer) {
+		w.Family("test_seconds", Histogram, "Test histogram")
+		w.Histogram("test_seconds", Labels{"queue": `a"b`}, []float64{0.1, 1}, []int64{1, 2, 3}, 12.5)
+	})
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, line := range []string{
+		"# TYPE metric_collector_test_seconds histogram",
+		`metric_collector_test_seconds_bucket{le="0.1",queue="a\"b"} 1`,
+		`metric_collector_test_seconds_bucket{le="1",queue="a\"b"} 3`,
+		`metric_collector_test_seconds_bucket{le="+Inf",queue="a\"b"} 6`,
+		`metric_collector_test_seconds_sum{queue="a\"b"} 12.5`,
+		`metric_collector_test_seconds_count{queue="a\"b"} 6`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expected line %q in:\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package queue
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// BatchSizeHeader is set in messages packing several metrics, it holds the
+// number of metrics in the body. Packed bodies are a sequence of metrics,
+// each one encoded with the message codec and prefixed by its length (uvarint)
+const BatchSizeHeader = "x-batch-size"
+
+// confirmWindow is the maximum number of messages published before waiting
+// for the broker confirmations
+const confirmWindow = 256
+
+// ErrNotConfirmed is returned for metrics the broker couldn't store
+var ErrNotConfirmed = errors.New("Message not confirmed by the broker")
+
+// SetBatchPacking sets how many metrics PublishBatch packs in a single
+// message, 1 (default) sends a message per metric
+// Consumers unpack them transparently
+func (c *RabbitMQChannel) SetBatchPacking(metricsPerMessage int) {
+	c.Lock()
+	c.packing = metricsPerMessage
+	c.Unlock()
+}
+
+// PublishBatch to the given exchange, waiting for the broker to confirm
+// them. It returns an error per metric, nil if it was stored
+// Only metrics with the same routing key are packed together
+func (c *RabbitMQChannel) PublishBatch(exchange string, metrics []MetricData) []error {
+	results := make([]error, len(metrics))
+
+	c.Lock()
+	codec := c.codec
+	packing := c.packing
+	routingTags := c.routingTags
+	c.Unlock()
+	if packing < 1 {
+		packing = 1
+	}
+
+	// Group metrics by routing key, only metrics sharing it can be packed
+	var keys []string
+	groups := make(map[string][]int)
+	for i := range metrics {
+		key := RoutingKey(&metrics[i], routingTags...)
+		if groups[key] == nil {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], i)
+	}
+
+	// Build messages, keeping the indexes of the metrics in each of them
+	var msgs []amqp.Publishing
+	var routingKeys []string
+	var owners [][]int
+	for _, key := range keys {
+		group := groups[key]
+		for from := 0; from < len(group); from += packing {
+			to := from + packing
+			if to > len(group) {
+				to = len(group)
+			}
+
+			packed := make([]MetricData, 0, to-from)
+			for _, i := range group[from:to] {
+				packed = append(packed, metrics[i])
+			}
+
+			msg, err := encodeBatch(codec, packed)
+			if err != nil {
+				for _, i := range group[from:to] {
+					results[i] = err
+				}
+				continue
+			}
+			msgs = append(msgs, msg)
+			routingKeys = append(routingKeys, key)
+			owners = append(owners, group[from:to])
+		}
+	}
+
+	fail := func(msg int, err error) {
+		for _, i := range owners[msg] {
+			results[i] = err
+		}
+	}
+
+	// Publish them in confirm mode, one batch at a time
+	c.confirmMu.Lock()
+	defer c.confirmMu.Unlock()
+	for start := 0; start < len(msgs); start += confirmWindow {
+		end := start + confirmWindow
+		if end > len(msgs) {
+			end = len(msgs)
+		}
+
+		ch, confirms, err := c.confirmChannel()
+		if err != nil {
+			for i := start; i < len(msgs); i++ {
+				fail(i, err)
+			}
+			break
+		}
+
+		published := start
+		for ; published < end; published++ {
+			err := ch.Publish(exchange, routingKeys[published], false, false, msgs[published])
+			if err != nil {
+				// The channel is unusable, open a new one for the next batch
+				for i := published; i < end; i++ {
+					fail(i, err)
+				}
+				c.resetConfirmChannel(ch)
+				break
+			}
+		}
+
+		// Confirmations arrive in publishing order
+		for i := start; i < published; i++ {
+			confirm, ok := <-confirms
+			if !ok {
+				// Channel closed, outcome unknown
+				for j := i; j < published; j++ {
+					fail(j, ErrNotConnected)
+				}
+				c.resetConfirmChannel(ch)
+				break
+			}
+			if !confirm.Ack {
+				fail(i, ErrNotConfirmed)
+			}
+		}
+	}
+
+	return results
+}
+
+// publishConfirmed publishes a single message in confirm mode, waiting for
+// the broker to confirm it
+func (c *RabbitMQChannel) publishConfirmed(exchange, key string, msg amqp.Publishing) error {
+	c.confirmMu.Lock()
+	defer c.confirmMu.Unlock()
+
+	ch, confirms, err := c.confirmChannel()
+	if err != nil {
+		return err
+	}
+	if err := ch.Publish(exchange, key, false, false, msg); err != nil {
+		c.resetConfirmChannel(ch)
+		return err
+	}
+
+	confirm, ok := <-confirms
+	if !ok {
+		c.resetConfirmChannel(ch)
+		return ErrNotConnected
+	}
+	if !confirm.Ack {
+		return ErrNotConfirmed
+	}
+	return nil
+}
+
+// confirmChannel returns the channel in confirm mode, opening it if needed
+func (c *RabbitMQChannel) confirmChannel() (*amqp.Channel, <-chan amqp.Confirmation, error) {
+	c.Lock()
+	defer c.Unlock()
+	if !c.connected {
+		return nil, nil, ErrNotConnected
+	}
+
+	if c.confirmCh == nil {
+		ch, err := c.conn.Channel()
+		if err != nil {
+			return nil, nil, err
+		}
+		if err = ch.Confirm(false); err != nil {
+			ch.Close()
+			return nil, nil, err
+		}
+		c.confirmCh = ch
+		c.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, confirmWindow))
+	}
+
+	return c.confirmCh, c.confirms, nil
+}
+
+// resetConfirmChannel forgets the given confirm channel, so a new one is opened
+func (c *RabbitMQChannel) resetConfirmChannel(ch *amqp.Channel) {
+	c.Lock()
+	if c.confirmCh == ch {
+		c.confirmCh = nil
+	}
+	c.Unlock()
+}
+
+// encodeBatch returns a message for the given metrics, packing them if
+// there are more than one
+func encodeBatch(codec Codec, metrics []MetricData) (amqp.Publishing, error) {
+	msg := amqp.Publishing{
+		DeliveryMode: amqp.Persistent,
+		ContentType:  codec.ContentType(),
+	}
+
+	if len(metrics) == 1 {
+		body, err := codec.Marshal(&metrics[0])
+		msg.Body = body
+		return msg, err
+	}
+
+	body, err := pack(codec, metrics)
+	msg.Body = body
+	msg.Headers = amqp.Table{BatchSizeHeader: int32(len(metrics))}
+	return msg, err
+}
+
+// pack metrics in a single body
+func pack(codec Codec, metrics []MetricData) ([]byte, error) {
+	var body []byte
+	var size [binary.MaxVarintLen64]byte
+	for i := range metrics {
+		b, err := codec.Marshal(&metrics[i])
+		if err != nil {
+			return nil, err
+		}
+		n := binary.PutUvarint(size[:], uint64(len(b)))
+		body = append(body, size[:n]...)
+		body = append(body, b...)
+	}
+	return body, nil
+}
+
+// unpack returns the n metric bodies in a packed body
+func unpack(body []byte, n int) ([][]byte, error) {
+	parts := make([][]byte, 0, n)
+	for len(body) > 0 {
+		size, read := binary.Uvarint(body)
+		if read <= 0 || uint64(len(body)-read) < size {
+			return nil, errors.New("Malformed packed metrics")
+		}
+		body = body[read:]
+		parts = append(parts, body[:size])
+		body = body[size:]
+	}
+
+	if len(parts) != n {
+		return nil, fmt.Errorf("Expected %d packed metrics, found %d", n, len(parts))
+	}
+	return parts, nil
+}
+
+// messages returns the metric messages in a delivery, unpacking it if needed
+func (c *RabbitMQChannel) messages(d amqp.Delivery, queue string) []*RabbitMQMetricMessage {
+	size, packed := intHeader(d.Headers, BatchSizeHeader)
+	if !packed {
+		return []*RabbitMQMetricMessage{{d: d, channel: c, queue: queue}}
+	}
+
+	body, err := decompress(d.ContentEncoding, d.Body)
+	var parts [][]byte
+	if err == nil {
+		parts, err = unpack(body, size)
+	}
+	if err != nil {
+		// Deliver it as a single message, so it gets dead-lettered
+		return []*RabbitMQMetricMessage{{d: d, channel: c, queue: queue, err: err}}
+	}
+
+	if len(parts) == 0 {
+		d.Ack(false)
+		return nil
+	}
+
+	batch := &packedDelivery{d: d, pending: len(parts)}
+	res := make([]*RabbitMQMetricMessage, len(parts))
+	for i, part := range parts {
+		res[i] = &RabbitMQMetricMessage{d: d, channel: c, queue: queue, batch: batch, body: part}
+	}
+	return res
+}
+
+// packedDelivery is a delivery holding several metrics, it's acked when all
+// of them are settled. Failed metrics are republished on their own, if that's
+// not possible the whole delivery is requeued
+type packedDelivery struct {
+	sync.Mutex
+	d       amqp.Delivery
+	pending int
+	failed  bool
+}
+
+// settle one of the metrics in the delivery
+func (b *packedDelivery) settle(ok bool) error {
+	b.Lock()
+	defer b.Unlock()
+	b.pending--
+	if !ok {
+		b.failed = true
+	}
+	if b.pending > 0 {
+		return nil
+	}
+
+	if b.failed {
+		return b.d.Nack(false, true)
+	}
+	return b.d.Ack(false)
+}
@@ -0,0 +1,111 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+// Helper acknowledger recording the last acknowledgement
+type testAcknowledger struct {
+	acks, nacks int
+}
+
+func (a *testAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.acks++
+	return nil
+}
+
+func (a *testAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.nacks++
+	return nil
+}
+
+func (a *testAcknowledger) Reject(tag uint64, requeue bool) error {
+	a.nacks++
+	return nil
+}
+
+func packedDeliveryFor(t *testing.T, codec Codec, metrics []MetricData) (amqp.Delivery, *testAcknowledger) {
+	msg, err := encodeBatch(codec, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack := &testAcknowledger{}
+	return amqp.Delivery{
+		Acknowledger: ack,
+		Headers:      msg.Headers,
+		ContentType:  msg.ContentType,
+		Body:         msg.Body,
+	}, ack
+}
+
+var batchSample = []MetricData{
+	{Username: "user1", Count: 1, Metric: "metric1"},
+	{Username: "user2", Count: 2, Metric: "metric2"},
+	{Username: "user3", Count: 3, Metric: "metric3"},
+}
+
+func TestPackedDeliveryUnpacks(t *testing.T) {
+	for name, codec := range codecs {
+		d, _ := packedDeliveryFor(t, codec, batchSample)
+		msgs := (&RabbitMQChannel{}).messages(d, "queue")
+		if len(msgs) != len(batchSample) {
+			t.Errorf("%s: expected %d metrics, got %d", name, len(batchSample), len(msgs))
+			continue
+		}
+
+		for i, m := range msgs {
+			data, err := m.MetricData()
+			if err != nil {
+				t.Errorf("%s: reading metric data: %s", name, err)
+			}
+			if data.Username != batchSample[i].Username || data.Count != batchSample[i].Count {
+				t.Errorf("%s: expected %#v, got %#v", name, batchSample[i], data)
+			}
+		}
+	}
+}
+
+func TestPackedDeliveryAckedWhenAllAcked(t *testing.T) {
+	d, ack := packedDeliveryFor(t, JSON, batchSample)
+	msgs := (&RabbitMQChannel{}).messages(d, "queue")
+
+	for _, m := range msgs {
+		if ack.acks != 0 {
+			t.Fatal("Packed delivery acked before all its metrics")
+		}
+		m.Ack()
+	}
+
+	if ack.acks != 1 || ack.nacks != 0 {
+		t.Errorf("Expected packed delivery acked once, got %d acks, %d nacks", ack.acks, ack.nacks)
+	}
+}
+
+func TestPackedDeliveryRequeuedIfRepublishFails(t *testing.T) {
+	d, ack := packedDeliveryFor(t, JSON, batchSample)
+	// Not connected, republishing will fail
+	msgs := (&RabbitMQChannel{}).messages(d, "queue")
+
+	msgs[0].Ack()
+	msgs[1].Nack()
+	msgs[2].Ack()
+
+	if ack.acks != 0 || ack.nacks != 1 {
+		t.Errorf("Expected packed delivery requeued, got %d acks, %d nacks", ack.acks, ack.nacks)
+	}
+}
+
+func TestMalformedPackedDelivery(t *testing.T) {
+	d, _ := packedDeliveryFor(t, JSON, batchSample)
+	d.Body = d.Body[:len(d.Body)-3]
+
+	msgs := (&RabbitMQChannel{}).messages(d, "queue")
+	if len(msgs) != 1 {
+		t.Fatalf("Expected a single undecodable message, got %d", len(msgs))
+	}
+	if _, err := msgs[0].MetricData(); err == nil {
+		t.Error("Expected error reading malformed packed metrics")
+	}
+}
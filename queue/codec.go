@@ -0,0 +1,330 @@
+package queue
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/ugorji/go/codec"
+)
+
+// Codec encodes and decodes MetricData for the wire
+type Codec interface {
+	// ContentType used to identify messages encoded with this codec
+	ContentType() string
+
+	// Marshal the given metric
+	Marshal(d *MetricData) ([]byte, error)
+
+	// Unmarshal data into the given metric
+	Unmarshal(data []byte, d *MetricData) error
+}
+
+var (
+	// JSON codec, default one
+	JSON Codec = jsonCodec{}
+
+	// MessagePack codec, time is sent as unix nanoseconds
+	MessagePack Codec = msgpackCodec{}
+
+	// Protobuf codec, see metric.proto for the schema
+	Protobuf Codec = protobufCodec{}
+)
+
+// codecs by name
+var codecs = map[string]Codec{
+	"json":     JSON,
+	"msgpack":  MessagePack,
+	"protobuf": Protobuf,
+}
+
+// codecs by content type, including legacy and alternative names
+var contentTypes = map[string]Codec{
+	"":                       JSON,
+	"text/plain":             JSON,
+	"application/json":       JSON,
+	"application/msgpack":    MessagePack,
+	"application/x-msgpack":  MessagePack,
+	"application/protobuf":   Protobuf,
+	"application/x-protobuf": Protobuf,
+}
+
+// CodecByName returns the codec with the given name (json, msgpack or protobuf)
+func CodecByName(name string) (Codec, error) {
+	if c, ok := codecs[name]; ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("Unknown codec '%s'", name)
+}
+
+// codecFor returns the codec for the given content type
+func codecFor(contentType string) (Codec, error) {
+	if c, ok := contentTypes[contentType]; ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("Unsupported content type '%s'", contentType)
+}
+
+// decompress a message body according to its content encoding
+func decompress(contentEncoding string, body []byte) ([]byte, error) {
+	switch contentEncoding {
+	case "", "identity":
+		return body, nil
+	case "gzip":
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	default:
+		return nil, fmt.Errorf("Unsupported content encoding '%s'", contentEncoding)
+	}
+}
+
+// JSON
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return "application/json"
+}
+
+func (jsonCodec) Marshal(d *MetricData) ([]byte, error) {
+	return json.Marshal(d)
+}
+
+func (jsonCodec) Unmarshal(data []byte, d *MetricData) error {
+	return json.Unmarshal(data, d)
+}
+
+// MessagePack
+
+var msgpackHandle codec.MsgpackHandle
+
+type msgpackMetric struct {
+	Username string            `codec:"username"`
+	Count    int64             `codec:"count"`
+	Metric   string            `codec:"metric"`
+	Time     int64             `codec:"time,omitempty"`
+	Tags     map[string]string `codec:"tags,omitempty"`
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string {
+	return "application/msgpack"
+}
+
+func (msgpackCodec) Marshal(d *MetricData) ([]byte, error) {
+	m := msgpackMetric{
+		Username: d.Username,
+		Count:    d.Count,
+		Metric:   d.Metric,
+		Time:     unixNano(d.Time),
+		Tags:     d.Tags,
+	}
+
+	var b []byte
+	err := codec.NewEncoderBytes(&b, &msgpackHandle).Encode(&m)
+	return b, err
+}
+
+func (msgpackCodec) Unmarshal(data []byte, d *MetricData) error {
+	var m msgpackMetric
+	if err := codec.NewDecoderBytes(data, &msgpackHandle).Decode(&m); err != nil {
+		return err
+	}
+
+	*d = MetricData{
+		Username: m.Username,
+		Count:    m.Count,
+		Metric:   m.Metric,
+		Time:     fromUnixNano(m.Time),
+		Tags:     m.Tags,
+	}
+	return nil
+}
+
+// Protobuf, field numbers from metric.proto
+
+const (
+	protoUsername = 1
+	protoCount    = 2
+	protoMetric   = 3
+	protoTime     = 4
+	protoTags     = 5
+
+	protoTagKey   = 1
+	protoTagValue = 2
+)
+
+// Protobuf wire types
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// errMalformedProto is returned for truncated or invalid protobuf messages
+var errMalformedProto = errors.New("Malformed protobuf message")
+
+type protobufCodec struct{}
+
+func (protobufCodec) ContentType() string {
+	return "application/x-protobuf"
+}
+
+func (protobufCodec) Marshal(d *MetricData) ([]byte, error) {
+	var b []byte
+	if d.Username != "" {
+		b = appendProtoBytes(b, protoUsername, []byte(d.Username))
+	}
+	if d.Count != 0 {
+		b = appendProtoVarint(b, protoCount, uint64(d.Count))
+	}
+	if d.Metric != "" {
+		b = appendProtoBytes(b, protoMetric, []byte(d.Metric))
+	}
+	if t := unixNano(d.Time); t != 0 {
+		b = appendProtoVarint(b, protoTime, uint64(t))
+	}
+	for k, v := range d.Tags {
+		var entry []byte
+		entry = appendProtoBytes(entry, protoTagKey, []byte(k))
+		entry = appendProtoBytes(entry, protoTagValue, []byte(v))
+		b = appendProtoBytes(b, protoTags, entry)
+	}
+	return b, nil
+}
+
+func (protobufCodec) Unmarshal(data []byte, d *MetricData) error {
+	*d = MetricData{}
+	return consumeProto(data, func(num, typ int, varint uint64, bytes []byte) error {
+		switch {
+		case num == protoUsername && typ == protoBytes:
+			d.Username = string(bytes)
+		case num == protoCount && typ == protoVarint:
+			d.Count = int64(varint)
+		case num == protoMetric && typ == protoBytes:
+			d.Metric = string(bytes)
+		case num == protoTime && typ == protoVarint:
+			d.Time = fromUnixNano(int64(varint))
+		case num == protoTags && typ == protoBytes:
+			if d.Tags == nil {
+				d.Tags = make(map[string]string)
+			}
+			return unmarshalProtoTag(bytes, d.Tags)
+		}
+		// Unknown fields are skipped
+		return nil
+	})
+}
+
+// unmarshalProtoTag decodes a map entry into tags
+func unmarshalProtoTag(data []byte, tags map[string]string) error {
+	var key, value string
+	err := consumeProto(data, func(num, typ int, varint uint64, bytes []byte) error {
+		switch {
+		case num == protoTagKey && typ == protoBytes:
+			key = string(bytes)
+		case num == protoTagValue && typ == protoBytes:
+			value = string(bytes)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	tags[key] = value
+	return nil
+}
+
+// appendProtoVarint appends a varint field
+func appendProtoVarint(b []byte, num int, v uint64) []byte {
+	b = appendVarint(b, uint64(num)<<3|protoVarint)
+	return appendVarint(b, v)
+}
+
+// appendProtoBytes appends a length-delimited field
+func appendProtoBytes(b []byte, num int, v []byte) []byte {
+	b = appendVarint(b, uint64(num)<<3|protoBytes)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+// consumeProto calls field with every field in data, with its value in
+// varint (varint fields) or bytes (length-delimited ones). Fixed size fields
+// are skipped
+func consumeProto(data []byte, field func(num, typ int, varint uint64, bytes []byte) error) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 || tag>>3 == 0 {
+			return errMalformedProto
+		}
+		data = data[n:]
+
+		num, typ := int(tag>>3), int(tag&7)
+		var varint uint64
+		var bytes []byte
+		switch typ {
+		case protoVarint:
+			if varint, n = binary.Uvarint(data); n <= 0 {
+				return errMalformedProto
+			}
+		case protoBytes:
+			size, read := binary.Uvarint(data)
+			if read <= 0 || uint64(len(data)-read) < size {
+				return errMalformedProto
+			}
+			bytes = data[read : read+int(size)]
+			n = read + int(size)
+		case protoFixed64:
+			n = 8
+		case protoFixed32:
+			n = 4
+		default:
+			return fmt.Errorf("Unsupported protobuf wire type %d", typ)
+		}
+		if len(data) < n {
+			return errMalformedProto
+		}
+		data = data[n:]
+
+		if typ == protoVarint || typ == protoBytes {
+			if err := field(num, typ, varint, bytes); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Helpers
+
+// unixNano returns t as unix nanoseconds, 0 for the zero time
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// fromUnixNano returns the time for the given unix nanoseconds, zero time for 0
+func fromUnixNano(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns).UTC()
+}
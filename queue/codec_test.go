@@ -0,0 +1,116 @@
+package queue
+
+import (
+	"bytes"
+	"compress/gzip"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+var codecSample = MetricData{
+	Username: "user",
+	Count:    1234,
+	Metric:   "metric",
+	Time:     time.Date(2016, 5, 4, 10, 0, 0, 500, time.UTC),
+	Tags:     map[string]string{"env": "prod", "region": "eu"},
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	for name, codec := range codecs {
+		for _, sent := range []MetricData{codecSample, {Username: "user", Metric: "metric"}} {
+			body, err := codec.Marshal(&sent)
+			if err != nil {
+				t.Errorf("%s: marshalling: %s", name, err)
+				continue
+			}
+
+			var received MetricData
+			if err = codec.Unmarshal(body, &received); err != nil {
+				t.Errorf("%s: unmarshalling: %s", name, err)
+				continue
+			}
+
+			if !received.Time.Equal(sent.Time) {
+				t.Errorf("%s: wrong time %s, expected %s", name, received.Time, sent.Time)
+			}
+			received.Time = sent.Time
+			if !reflect.DeepEqual(received, sent) {
+				t.Errorf("%s: expected %#v, got %#v", name, sent, received)
+			}
+		}
+	}
+}
+
+func TestMetricDataDetectsCodec(t *testing.T) {
+	for name, codec := range codecs {
+		body, err := codec.Marshal(&codecSample)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := &RabbitMQMetricMessage{d: amqp.Delivery{ContentType: codec.ContentType(), Body: body}}
+		data, err := m.MetricData()
+		if err != nil {
+			t.Errorf("%s: reading metric data: %s", name, err)
+			continue
+		}
+		if data.Username != codecSample.Username || data.Count != codecSample.Count {
+			t.Errorf("%s: wrong metric data %#v", name, data)
+		}
+	}
+}
+
+func TestMetricDataGzipEncoding(t *testing.T) {
+	body, _ := MessagePack.Marshal(&codecSample)
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(body)
+	w.Close()
+
+	m := &RabbitMQMetricMessage{d: amqp.Delivery{
+		ContentType:     MessagePack.ContentType(),
+		ContentEncoding: "gzip",
+		Body:            buf.Bytes(),
+	}}
+	data, err := m.MetricData()
+	if err != nil {
+		t.Fatal("Reading metric data", err)
+	}
+	if data.Metric != codecSample.Metric {
+		t.Errorf("Wrong metric data %#v", data)
+	}
+}
+
+func TestMetricDataUnknownContentType(t *testing.T) {
+	m := &RabbitMQMetricMessage{d: amqp.Delivery{ContentType: "application/xml", Body: []byte("<metric/>")}}
+	if _, err := m.MetricData(); err == nil {
+		t.Error("Expected error for unsupported content type")
+	}
+}
+
+func TestProtobufUnknownAndMalformed(t *testing.T) {
+	body, _ := Protobuf.Marshal(&codecSample)
+
+	// Unknown fields of every wire type are skipped
+	unknown := appendProtoVarint(nil, 10, 1)
+	unknown = appendProtoBytes(unknown, 11, []byte("ignored"))
+	unknown = append(unknown, 12<<3|protoFixed64, 0, 0, 0, 0, 0, 0, 0, 0)
+	unknown = append(unknown, 13<<3|protoFixed32, 0, 0, 0, 0)
+	var data MetricData
+	if err := Protobuf.Unmarshal(append(unknown, body...), &data); err != nil {
+		t.Fatal("Unmarshalling with unknown fields", err)
+	}
+	if data.Username != codecSample.Username || data.Tags["env"] != "prod" {
+		t.Errorf("Wrong metric data %#v", data)
+	}
+
+	if err := Protobuf.Unmarshal(body[:len(body)-1], &data); err == nil {
+		t.Error("Expected error for truncated message")
+	}
+	if err := Protobuf.Unmarshal([]byte{0, 1}, &data); err == nil {
+		t.Error("Expected error for field number 0")
+	}
+}
@@ -1,72 +1,242 @@
 package queue
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// DummyQueueSize is the number of messages a dummy queue can hold before
+// publishing blocks
+const DummyQueueSize = 1000
 
 // DummyChannel implements in memory queue.Channel
 type DummyChannel struct {
-	// map exchanges -> queues -> listener channels
-	exchanges map[string]map[string][]chan MetricMessage
+	sync.Mutex
+	exchanges map[string]*dummyExchange
+	queues    map[string]chan MetricMessage
+	closed    bool
+
+	// tags added to routing keys
+	routingTags []string
+}
+
+type dummyExchange struct {
+	kind     string
+	bindings []dummyBinding
+}
+
+type dummyBinding struct {
+	queue   string
+	pattern string
 }
 
 // DummyMetricMessage implementes queue.Metric
 type DummyMetricMessage struct {
-	data  MetricData
-	Acked bool
+	data     MetricData
+	Acked    bool
+	Nacked   bool
+	Rejected bool
+	Requeued bool
+
+	// Times this message was requeued
+	Retries int
+
+	channel *DummyChannel
+	queue   string
+}
+
+// NewDummyMetricMessage returns a message holding the given data, see Deliver
+func NewDummyMetricMessage(data MetricData) *DummyMetricMessage {
+	return &DummyMetricMessage{data: data}
 }
 
 // Dummy creates an in memory queue channel (for testing)
 func Dummy() *DummyChannel {
 	return &DummyChannel{
-		exchanges: make(map[string]map[string][]chan MetricMessage),
+		exchanges: make(map[string]*dummyExchange),
+		queues:    make(map[string]chan MetricMessage),
 	}
 }
 
-// DeclareExchange creates a exchnage (fanout type), no durable (ignores param)
-func (c *DummyChannel) DeclareExchange(exchange string, durable bool) error {
-	if c.exchanges[exchange] == nil {
-		c.exchanges[exchange] = make(map[string][]chan MetricMessage)
+// SetRoutingTags sets the tags appended to routing keys, see RoutingKey
+func (c *DummyChannel) SetRoutingTags(tags ...string) {
+	c.Lock()
+	c.routingTags = tags
+	c.Unlock()
+}
+
+// DeclareExchange creates a exchnage of the given type, no durable (ignores param)
+func (c *DummyChannel) DeclareExchange(exchange string, kind string, durable bool) error {
+	c.Lock()
+	defer c.Unlock()
+	return c.declareExchange(exchange, kind)
+}
+
+func (c *DummyChannel) declareExchange(exchange string, kind string) error {
+	if e := c.exchanges[exchange]; e != nil {
+		if e.kind != kind {
+			return fmt.Errorf("Exchange '%s' already declared as %s", exchange, e.kind)
+		}
+		return nil
 	}
+	c.exchanges[exchange] = &dummyExchange{kind: kind}
 	return nil
 }
 
 // DeclareQueue creates a queue, binds it to the exchange, no durable (ignores param)
-func (c *DummyChannel) DeclareQueue(exchange string, queue string, durable bool) error {
-	if c.exchanges[exchange][queue] == nil {
-		c.exchanges[exchange][queue] = make([]chan MetricMessage, 0)
+func (c *DummyChannel) DeclareQueue(exchange string, queue string, durable bool, bindings ...string) error {
+	c.Lock()
+	defer c.Unlock()
+	e := c.exchanges[exchange]
+	if e == nil {
+		return errors.New("Exchange not found")
+	}
+	bindings, err := queueBindings(e.kind, bindings)
+	if err != nil {
+		return err
+	}
+
+	// Dead-letter exchange and queue
+	dlx := DeadLetterExchange(exchange)
+	if err := c.declareExchange(dlx, Direct); err != nil {
+		return err
+	}
+	c.bind(dlx, DeadLetterQueue(queue), queue)
+
+	for _, pattern := range bindings {
+		c.bind(exchange, queue, pattern)
 	}
 	return nil
 }
 
+// bind a queue to an exchange, creating the queue if needed
+func (c *DummyChannel) bind(exchange, queue, pattern string) {
+	if c.queues[queue] == nil {
+		c.queues[queue] = make(chan MetricMessage, DummyQueueSize)
+	}
+
+	e := c.exchanges[exchange]
+	for _, b := range e.bindings {
+		if b.queue == queue && b.pattern == pattern {
+			return
+		}
+	}
+	e.bindings = append(e.bindings, dummyBinding{queue: queue, pattern: pattern})
+}
+
 // PublishMetric to the given exchange
 func (c *DummyChannel) PublishMetric(exchange string, metric *MetricData) error {
-	for queue := range c.exchanges[exchange] {
-		for _, listener := range c.exchanges[exchange][queue] {
-			listener <- &DummyMetricMessage{data: *metric, Acked: false}
+	c.Lock()
+	defer c.Unlock()
+	return c.route(exchange, RoutingKey(metric, c.routingTags...), metric, 0)
+}
+
+// PublishBatch to the given exchange
+func (c *DummyChannel) PublishBatch(exchange string, metrics []MetricData) []error {
+	results := make([]error, len(metrics))
+	for i := range metrics {
+		results[i] = c.PublishMetric(exchange, &metrics[i])
+	}
+	return results
+}
+
+// route a metric to the queues bound to exchange (at most once per queue),
+// following the same rules as RabbitMQ
+func (c *DummyChannel) route(exchange, key string, metric *MetricData, retries int) error {
+	if c.closed {
+		return errors.New("Channel closed")
+	}
+	e := c.exchanges[exchange]
+	if e == nil {
+		return errors.New("Exchange not found")
+	}
+
+	routed := make(map[string]bool)
+	for _, b := range e.bindings {
+		if routed[b.queue] || !routes(e.kind, b.pattern, key) {
+			continue
 		}
+		routed[b.queue] = true
+		c.queues[b.queue] <- &DummyMetricMessage{data: *metric, Retries: retries, channel: c, queue: b.queue}
+	}
+	return nil
+}
+
+// requeue sends a copy of the given message to its queue, unless closed
+func (c *DummyChannel) requeue(m *DummyMetricMessage, retries int) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return errors.New("Channel closed")
+	}
+	q := c.queues[m.queue]
+	if q == nil {
+		return errors.New("Queue not found")
 	}
+	q <- &DummyMetricMessage{data: m.data, Retries: retries, channel: c, queue: m.queue}
 	return nil
 }
 
-// ConsumeMetrics returns a channel receiving metrics from the given queue
-func (c *DummyChannel) ConsumeMetrics(queue string) (<-chan MetricMessage, error) {
-	for _, queues := range c.exchanges {
-		if queues[queue] != nil {
-			ch := make(chan MetricMessage)
-			queues[queue] = append(queues[queue], ch)
-			return ch, nil
+// deadLetter routes a copy of the given message trough the dead-letter
+// exchanges, using the queue name as routing key
+func (c *DummyChannel) deadLetter(m *DummyMetricMessage) error {
+	c.Lock()
+	defer c.Unlock()
+	for name, e := range c.exchanges {
+		for _, b := range e.bindings {
+			if b.queue == DeadLetterQueue(m.queue) {
+				return c.route(name, m.queue, &m.data, m.Retries)
+			}
 		}
 	}
-	return nil, errors.New("Queue not found")
+	return errors.New("Dead-letter queue not found")
+}
+
+// Deliver the given message to a queue, allows inspecting message
+// acknowledgements from tests
+func (c *DummyChannel) Deliver(queue string, m MetricMessage) error {
+	q := c.queue(queue)
+	if q == nil {
+		return errors.New("Queue not found")
+	}
+	q <- m
+	return nil
+}
+
+// ConsumeMetrics returns a channel receiving metrics from the given queue,
+// consumers of the same queue compete for its messages. Prefetch is ignored
+func (c *DummyChannel) ConsumeMetrics(queue string, prefetch int) (<-chan MetricMessage, error) {
+	q := c.queue(queue)
+	if q == nil {
+		return nil, errors.New("Queue not found")
+	}
+	return q, nil
+}
+
+// Check returns an error once the channel is closed
+func (c *DummyChannel) Check() error {
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return errors.New("Channel closed")
+	}
+	return nil
+}
+
+func (c *DummyChannel) queue(name string) chan MetricMessage {
+	c.Lock()
+	defer c.Unlock()
+	return c.queues[name]
 }
 
 // Close the connection, must be called when no longer necessary
 func (c *DummyChannel) Close() error {
-	for _, queues := range c.exchanges {
-		for _, chs := range queues {
-			for _, ch := range chs {
-				close(ch)
-			}
-		}
+	c.Lock()
+	defer c.Unlock()
+	c.closed = true
+	for _, q := range c.queues {
+		close(q)
 	}
 	return nil
 }
@@ -86,5 +256,32 @@ func (m *DummyMetricMessage) Ack() error {
 
 // Nack negatively acknowledges the message, forcing requeuing
 func (m *DummyMetricMessage) Nack() error {
-	return nil
+	m.Nacked = true
+	if m.channel == nil {
+		return nil
+	}
+	return m.channel.requeue(m, m.Retries+1)
+}
+
+// Reject the message, sending it to the dead-letter queue
+func (m *DummyMetricMessage) Reject() error {
+	m.Rejected = true
+	if m.channel == nil {
+		return nil
+	}
+	return m.channel.deadLetter(m)
+}
+
+// Requeue the message as it is, without increasing its retries
+func (m *DummyMetricMessage) Requeue() error {
+	m.Requeued = true
+	if m.channel == nil {
+		return nil
+	}
+	return m.channel.requeue(m, m.Retries)
+}
+
+// Attempts returns the delivery attempt of this message, 1 the first time
+func (m *DummyMetricMessage) Attempts() int {
+	return m.Retries + 1
 }
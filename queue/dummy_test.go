@@ -0,0 +1,59 @@
+package queue
+
+import "testing"
+
+func TestDummyNackRequeuesWithRetries(t *testing.T) {
+	channel := Dummy()
+	channel.DeclareExchange("foo", Fanout, true)
+	channel.DeclareQueue("foo", "bar", true)
+	metrics, _ := channel.ConsumeMetrics("bar", 1)
+
+	channel.PublishMetric("foo", &MetricData{Username: "user", Metric: "metric"})
+	m := <-metrics
+	if m.Attempts() != 1 {
+		t.Errorf("Expected first attempt, got %d", m.Attempts())
+	}
+
+	if err := m.Nack(); err != nil {
+		t.Fatal(err)
+	}
+	m = <-metrics
+	if m.Attempts() != 2 {
+		t.Errorf("Expected second attempt, got %d", m.Attempts())
+	}
+	if data, _ := m.MetricData(); data.Username != "user" {
+		t.Errorf("Wrong requeued data: %#v", data)
+	}
+}
+
+func TestDummyRejectDeadLetters(t *testing.T) {
+	channel := Dummy()
+	channel.DeclareExchange("foo", Fanout, true)
+	channel.DeclareQueue("foo", "bar", true)
+	metrics, _ := channel.ConsumeMetrics("bar", 1)
+	deadLetters, err := channel.ConsumeMetrics(DeadLetterQueue("bar"), 1)
+	if err != nil {
+		t.Fatal("Dead-letter queue not declared", err)
+	}
+
+	channel.PublishMetric("foo", &MetricData{Username: "user", Metric: "metric"})
+	m := <-metrics
+	if err := m.Reject(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m = <-deadLetters:
+		if data, _ := m.MetricData(); data.Username != "user" {
+			t.Errorf("Wrong dead-lettered data: %#v", data)
+		}
+	default:
+		t.Error("Rejected metric not found in the dead-letter queue")
+	}
+
+	select {
+	case <-metrics:
+		t.Error("Rejected metric was requeued")
+	default:
+	}
+}
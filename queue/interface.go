@@ -1,19 +1,35 @@
 package queue
 
+import "time"
+
 // Channel offers operations for defining queues, and sending / receiving tasks
 type Channel interface {
 
-	// DeclareExchange creates a exchnage (fanout type)
-	DeclareExchange(exchange string, durable bool) error
+	// DeclareExchange creates a exchnage of the given type (fanout, direct or topic)
+	DeclareExchange(exchange string, kind string, durable bool) error
+
+	// DeclareQueue creates a queue, binds it to the exchange and sets its
+	// durability settings. Queues that are not durable are transient, the
+	// broker deletes them once no one consumes them
+	// Bindings are routing keys or patterns (depending on the exchange type),
+	// if none is given the queue receives all metrics of fanout and topic
+	// exchanges, direct ones fail with ErrNoBindings
+	// It also declares the dead-letter exchange and queue for it
+	DeclareQueue(exchange string, queue string, durable bool, bindings ...string) error
 
-	// DeclareQueue creates a queue, binds it to the exchange and sets its durability settings
-	DeclareQueue(exchange string, queue string, durable bool) error
+	// SetRoutingTags sets the tags appended to routing keys, see RoutingKey
+	SetRoutingTags(tags ...string)
 
-	// PublishMetric to the given exchnage
+	// PublishMetric to the given exchnage, routed using RoutingKey
 	PublishMetric(exchange string, metric *MetricData) error
 
-	// ConsumeMetrics returns a channel receiving metrics from the given queue
-	ConsumeMetrics(queue string) (<-chan MetricMessage, error)
+	// PublishBatch to the given exchange, waiting for the broker to confirm
+	// them. It returns an error per metric, nil if it was stored
+	PublishBatch(exchange string, metrics []MetricData) []error
+
+	// ConsumeMetrics returns a channel receiving metrics from the given queue,
+	// with at most prefetch unacknowledged metrics at a time
+	ConsumeMetrics(queue string, prefetch int) (<-chan MetricMessage, error)
 
 	// Close the connection, must be called when no longer necessary
 	Close() error
@@ -24,6 +40,20 @@ type MetricData struct {
 	Username string `json:"username"`
 	Count    int64  `json:"count"`
 	Metric   string `json:"metric"`
+
+	// Time the event happened, as set by the producer (optional)
+	Time time.Time `json:"time"`
+	// Tags are free-form labels attached by the producer (optional)
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// EventTime returns the time the event happened, falling back to the current
+// time when the producer didn't set it
+func (d *MetricData) EventTime() time.Time {
+	if d.Time.IsZero() {
+		return time.Now()
+	}
+	return d.Time
 }
 
 // MetricMessage job sent trough a queue
@@ -34,6 +64,31 @@ type MetricMessage interface {
 	// Ack acknowledges metric processed (and stored) correctly
 	Ack() error
 
-	// Nack negatively acknowledges the message, forcing requeuing
+	// Nack negatively acknowledges the message, forcing requeuing and
+	// increasing its attempts count
 	Nack() error
+
+	// Reject the message, sending it to the dead-letter queue
+	Reject() error
+
+	// Requeue the message as it is, without increasing its attempts count,
+	// ie. when it was not processed
+	Requeue() error
+
+	// Attempts returns the delivery attempt of this message, 1 the first time
+	Attempts() int
+}
+
+// DeadLetterSuffix is appended to exchange and queue names to get their
+// dead-letter counterparts
+const DeadLetterSuffix = ".dead"
+
+// DeadLetterExchange returns the name of the dead-letter exchange for the given exchange
+func DeadLetterExchange(exchange string) string {
+	return exchange + DeadLetterSuffix
+}
+
+// DeadLetterQueue returns the name of the dead-letter queue for the given queue
+func DeadLetterQueue(queue string) string {
+	return queue + DeadLetterSuffix
 }
@@ -0,0 +1,13 @@
+package queue
+
+import "github.com/exekias/metric-collector/metrics"
+
+func init() {
+	metrics.Register(func(w *metrics.Writer) {
+		w.Family("rabbitmq_reconnects_total", metrics.Counter, "Times the connection to RabbitMQ was restored")
+		w.Sample("rabbitmq_reconnects_total", nil, float64(numReconnects.Value()))
+
+		w.Family("rabbitmq_connected", metrics.Gauge, "Channels currently connected to RabbitMQ")
+		w.Sample("rabbitmq_connected", nil, float64(numConnected.Value()))
+	})
+}
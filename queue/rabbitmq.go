@@ -1,110 +1,455 @@
 package queue
 
 import (
-	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
 
 	"github.com/streadway/amqp"
+
+	"github.com/exekias/metric-collector/logging"
+	"github.com/exekias/metric-collector/util"
+)
+
+var log = logging.MustGetLogger("queue")
+
+var (
+	numReconnects = expvar.NewInt("rabbitmq_reconnects")
+	numConnected  = expvar.NewInt("rabbitmq_connected") // channels currently connected
+)
+
+var (
+	// ErrNotConnected is returned when the connection is down (reconnecting)
+	ErrNotConnected = errors.New("Not connected to RabbitMQ")
+
+	// ErrClosed is returned when the channel was closed
+	ErrClosed = errors.New("Channel closed")
+)
+
+// RetriesHeader stores the times a message was requeued
+const RetriesHeader = "x-retries"
+
+// TransientQueueExpiry is the time queues that are not durable, and their
+// dead-letter queues, are kept without consumers
+const TransientQueueExpiry = time.Minute
+
+const (
+	// ReconnectDelay is the initial wait between reconnection attempts
+	ReconnectDelay = 500 * time.Millisecond
+
+	// MaxReconnectDelay is the maximum wait between reconnection attempts
+	MaxReconnectDelay = 30 * time.Second
 )
 
 // RabbitMQChannel implements queue.Channel
+// It reconnects transparently when the connection is lost, declaring again
+// the exchanges and queues and resuming the consumers
 type RabbitMQChannel struct {
+	sync.Mutex
+	url     string
 	conn    *amqp.Connection
 	channel *amqp.Channel
+
+	// declarations done in this channel, replayed on reconnection
+	declarations []func(ch *amqp.Channel) error
+	// consumers output channels and prefetch count by queue name
+	consumers map[string]chan MetricMessage
+	prefetch  map[string]int
+	// dead-letter exchanges by queue name
+	deadLetters map[string]string
+	// exchange types by name
+	kinds map[string]string
+	// tags added to routing keys
+	routingTags []string
+
+	connected  bool
+	reconnects int64
+
+	// codec used to publish metrics
+	codec Codec
+	// metrics packed per message by PublishBatch
+	packing int
+
+	// channel in confirm mode used by PublishBatch, opened on demand
+	confirmMu sync.Mutex
+	confirmCh *amqp.Channel
+	confirms  <-chan amqp.Confirmation
+
+	// closed when Close is called, only once
+	closed     chan struct{}
+	closeOnce  sync.Once
+	forwarders sync.WaitGroup
 }
 
 // RabbitMQMetricMessage implementes queue.Metric
 type RabbitMQMetricMessage struct {
 	d    amqp.Delivery
 	data MetricData
+	// error found unpacking the delivery, if any
+	err error
+
+	channel *RabbitMQChannel
+	queue   string
+
+	// delivery this metric was packed in along others, nil if it came alone
+	batch *packedDelivery
+	// body of this metric inside the packed delivery (already decompressed)
+	body []byte
 }
 
 // RabbitMQ creates a Rabbit MQ connection to the given URL and returns a channel
 func RabbitMQ(url string) (*RabbitMQChannel, error) {
-	conn, err := amqp.Dial(url)
-	if err != nil {
+	c := &RabbitMQChannel{
+		url:         url,
+		consumers:   make(map[string]chan MetricMessage),
+		prefetch:    make(map[string]int),
+		deadLetters: make(map[string]string),
+		kinds:       make(map[string]string),
+		closed:      make(chan struct{}),
+		codec:       JSON,
+	}
+
+	if err := c.connect(); err != nil {
 		return nil, err
 	}
 
+	return c, nil
+}
+
+// connect dials RabbitMQ, restores declarations and consumers and starts
+// watching the connection
+func (c *RabbitMQChannel) connect() error {
+	conn, err := amqp.Dial(c.url)
+	if err != nil {
+		return err
+	}
+
 	ch, err := conn.Channel()
 	if err != nil {
-		return nil, err
+		conn.Close()
+		return err
+	}
+	connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	chClosed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	c.Lock()
+	defer c.Unlock()
+
+	// Closed while reconnecting
+	select {
+	case <-c.closed:
+		conn.Close()
+		return ErrClosed
+	default:
+	}
+
+	for _, declare := range c.declarations {
+		if err = declare(ch); err != nil {
+			conn.Close()
+			return err
+		}
 	}
 
-	return &RabbitMQChannel{
-		conn:    conn,
-		channel: ch,
-	}, nil
+	for queue, res := range c.consumers {
+		msgs, err := consume(ch, queue, c.prefetch[queue])
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		c.forward(msgs, queue, res)
+	}
+
+	c.conn = conn
+	c.channel = ch
+	c.confirmCh = nil
+	c.connected = true
+	numConnected.Add(1)
+	go c.watch(conn, connClosed, chClosed)
+
+	return nil
 }
 
-// DeclareExchange creates a exchnage (fanout type)
-func (c *RabbitMQChannel) DeclareExchange(exchange string, durable bool) error {
-	return c.channel.ExchangeDeclare(
-		exchange, // name
-		"fanout", // type
-		durable,  // durable
-		false,    // auto-deleted
-		false,    // internal
-		false,    // no-wait
-		nil,      // arguments
-	)
+// watch waits for the connection or channel to be closed and reconnects
+// unless it was closed on purpose
+func (c *RabbitMQChannel) watch(conn *amqp.Connection, connClosed, chClosed <-chan *amqp.Error) {
+	var err *amqp.Error
+	select {
+	case err = <-connClosed:
+	case err = <-chClosed:
+	}
+
+	// Graceful close, nothing to do
+	if err == nil {
+		return
+	}
+
+	log.Warningf("Connection to RabbitMQ lost: %s", err)
+	c.Lock()
+	if c.connected {
+		c.connected = false
+		numConnected.Add(-1)
+	}
+	c.Unlock()
+	conn.Close()
+
+	backoff := util.ExponentialBackoffMax(ReconnectDelay, MaxReconnectDelay)
+	for {
+		select {
+		case <-c.closed:
+			return
+		default:
+		}
+
+		cerr := c.connect()
+		if cerr == nil {
+			break
+		}
+		log.Warningf("Could not reconnect to RabbitMQ: %s", cerr)
+		backoff()
+	}
+
+	c.Lock()
+	c.reconnects++
+	c.Unlock()
+	numReconnects.Add(1)
+	log.Info("Reconnected to RabbitMQ")
 }
 
-// DeclareQueue creates a queue, binds it to the exchange and sets its durability settings
-func (c *RabbitMQChannel) DeclareQueue(exchange string, queue string, durable bool) error {
-	_, err := c.channel.QueueDeclare(
-		queue,   // name
-		durable, // durable
-		false,   // delete when unused
-		false,   // exclusive
-		false,   // no-wait
-		nil,     // arguments
-	)
+// SetCodec sets the codec used to publish metrics, JSON by default
+// Consumed metrics are decoded using the codec matching their content type
+func (c *RabbitMQChannel) SetCodec(codec Codec) {
+	c.Lock()
+	c.codec = codec
+	c.Unlock()
+}
+
+// SetRoutingTags sets the tags appended to routing keys, see RoutingKey
+func (c *RabbitMQChannel) SetRoutingTags(tags ...string) {
+	c.Lock()
+	c.routingTags = tags
+	c.Unlock()
+}
+
+// Connected returns true if the connection to RabbitMQ is currently up
+func (c *RabbitMQChannel) Connected() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.connected
+}
+
+// Check returns ErrNotConnected while the connection to RabbitMQ is down
+func (c *RabbitMQChannel) Check() error {
+	if !c.Connected() {
+		return ErrNotConnected
+	}
+	return nil
+}
+
+// Reconnects returns the number of times the connection was restored
+func (c *RabbitMQChannel) Reconnects() int64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.reconnects
+}
+
+// declare runs the given declaration and records it for reconnections
+func (c *RabbitMQChannel) declare(declaration func(ch *amqp.Channel) error) error {
+	c.Lock()
+	defer c.Unlock()
+	if !c.connected {
+		return ErrNotConnected
+	}
+	if err := declaration(c.channel); err != nil {
+		return err
+	}
+	c.declarations = append(c.declarations, declaration)
+	return nil
+}
+
+// DeclareExchange creates a exchnage of the given type (fanout, direct or topic)
+func (c *RabbitMQChannel) DeclareExchange(exchange string, kind string, durable bool) error {
+	err := c.declare(func(ch *amqp.Channel) error {
+		return ch.ExchangeDeclare(
+			exchange, // name
+			kind,     // type
+			durable,  // durable
+			false,    // auto-deleted
+			false,    // internal
+			false,    // no-wait
+			nil,      // arguments
+		)
+	})
 	if err != nil {
 		return err
 	}
 
-	err = c.channel.QueueBind(
-		queue,    // queue name
-		"",       // routing key
-		exchange, // exchange
-		false,
-		nil)
+	c.Lock()
+	c.kinds[exchange] = kind
+	c.Unlock()
+	return nil
+}
 
-	return err
+// DeclareQueue creates a queue, binds it to the exchange and sets its
+// durability settings, queues that are not durable are transient (see
+// declareAndBind)
+// Bindings are routing keys or patterns (depending on the exchange type), if
+// none is given the queue receives all metrics of fanout and topic exchanges,
+// direct ones fail with ErrNoBindings
+// It also declares the dead-letter exchange (direct type) and queue for it,
+// rejected messages are routed there using the queue name as routing key
+func (c *RabbitMQChannel) DeclareQueue(exchange string, queue string, durable bool, bindings ...string) error {
+	c.Lock()
+	kind := c.kinds[exchange]
+	c.Unlock()
+	bindings, err := queueBindings(kind, bindings)
+	if err != nil {
+		return err
+	}
+
+	dlx := DeadLetterExchange(exchange)
+	err = c.declare(func(ch *amqp.Channel) error {
+		err := ch.ExchangeDeclare(
+			dlx,     // name
+			Direct,  // type
+			durable, // durable
+			false,   // auto-deleted
+			false,   // internal
+			false,   // no-wait
+			nil,     // arguments
+		)
+		if err != nil {
+			return err
+		}
+
+		if err = declareAndBind(ch, DeadLetterQueue(queue), dlx, durable, queue); err != nil {
+			return err
+		}
+
+		return declareAndBind(ch, queue, exchange, durable, bindings...)
+	})
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	c.deadLetters[queue] = dlx
+	c.Unlock()
+	return nil
+}
+
+// declareAndBind declares a queue and binds it to exchange with the given
+// keys. Queues that are not durable are transient: deleted once their
+// consumers are gone, or after TransientQueueExpiry if they never had one
+func declareAndBind(ch *amqp.Channel, queue, exchange string, durable bool, keys ...string) error {
+	var args amqp.Table
+	if !durable {
+		args = amqp.Table{"x-expires": int32(TransientQueueExpiry / time.Millisecond)}
+	}
+	_, err := ch.QueueDeclare(
+		queue,    // name
+		durable,  // durable
+		!durable, // delete when unused
+		false,    // exclusive
+		false,    // no-wait
+		args,     // arguments
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		err = ch.QueueBind(
+			queue,    // queue name
+			key,      // routing key
+			exchange, // exchange
+			false,
+			nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // PublishMetric to the given exchange
 func (c *RabbitMQChannel) PublishMetric(exchange string, metric *MetricData) error {
-	msg, err := json.Marshal(metric)
+	c.Lock()
+	codec := c.codec
+	key := RoutingKey(metric, c.routingTags...)
+	c.Unlock()
+
+	msg, err := codec.Marshal(metric)
 	if err != nil {
 		return err
 	}
 
-	return c.channel.Publish(
+	return c.publish(exchange, key, amqp.Publishing{
+		DeliveryMode: amqp.Persistent,
+		ContentType:  codec.ContentType(),
+		Body:         msg,
+	})
+}
+
+// publish a message using the current channel
+func (c *RabbitMQChannel) publish(exchange, key string, msg amqp.Publishing) error {
+	c.Lock()
+	ch := c.channel
+	connected := c.connected
+	c.Unlock()
+
+	if !connected {
+		return ErrNotConnected
+	}
+
+	return ch.Publish(
 		exchange, // exchange
-		"",       // routing key
+		key,      // routing key
 		false,    // mandatory
-		false,
-		amqp.Publishing{
-			DeliveryMode: amqp.Persistent,
-			ContentType:  "text/plain",
-			Body:         msg,
-		})
-}
-
-// ConsumeMetrics returns a channel receiving metrics from the given queue
-func (c *RabbitMQChannel) ConsumeMetrics(queue string) (<-chan MetricMessage, error) {
-	// Set QoS settings, TODO: benchmark and finetune
-	err := c.channel.Qos(
-		3,     // prefetch count
-		0,     // prefetch size
-		false, // global
+		false,    // immediate
+		msg)
+}
+
+// ConsumeMetrics returns a channel receiving metrics from the given queue,
+// with at most prefetch unacknowledged metrics at a time
+// The channel survives reconnections, it's only closed by Close
+func (c *RabbitMQChannel) ConsumeMetrics(queue string, prefetch int) (<-chan MetricMessage, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.consumers[queue] != nil {
+		return nil, fmt.Errorf("Already consuming from queue '%s'", queue)
+	}
+	if !c.connected {
+		return nil, ErrNotConnected
+	}
+
+	msgs, err := consume(c.channel, queue, prefetch)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(chan MetricMessage)
+	c.consumers[queue] = res
+	c.prefetch[queue] = prefetch
+	c.forward(msgs, queue, res)
+
+	return res, nil
+}
+
+// consume starts consuming deliveries from the given queue
+func consume(ch *amqp.Channel, queue string, prefetch int) (<-chan amqp.Delivery, error) {
+	// Set QoS settings, applies to the next consumer
+	err := ch.Qos(
+		prefetch, // prefetch count
+		0,        // prefetch size
+		false,    // global
 	)
 	if err != nil {
 		return nil, err
 	}
 
-	msgs, err := c.channel.Consume(
+	return ch.Consume(
 		queue, // queue
 		"",    // consumer
 		false, // auto-ack
@@ -113,39 +458,92 @@ func (c *RabbitMQChannel) ConsumeMetrics(queue string) (<-chan MetricMessage, er
 		false, // no-wait
 		nil,   // args
 	)
-	if err != nil {
-		return nil, err
-	}
+}
 
-	// Create generator consumer goroutine
-	res := make(chan MetricMessage)
+// forward deliveries to the consumer output channel until they stop (on
+// disconnection) or the channel is closed
+func (c *RabbitMQChannel) forward(msgs <-chan amqp.Delivery, queue string, res chan<- MetricMessage) {
+	c.forwarders.Add(1)
 	go func() {
+		defer c.forwarders.Done()
 		for d := range msgs {
-			res <- &RabbitMQMetricMessage{d: d}
+			for _, m := range c.messages(d, queue) {
+				select {
+				case res <- m:
+				case <-c.closed:
+					return
+				}
+			}
 		}
-		close(res)
 	}()
-
-	return res, nil
 }
 
-// Close the connection, must be called when no longer necessary
+// Close the connection, must be called when no longer necessary. Calling it
+// again does nothing
 func (c *RabbitMQChannel) Close() error {
+	first := false
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		first = true
+	})
+	if !first {
+		return nil
+	}
+
+	c.Lock()
+	connected := c.connected
+	c.connected = false
+	if connected {
+		numConnected.Add(-1)
+	}
+	c.Unlock()
+
 	// Close channel and connection
-	if err := c.channel.Close(); err != nil {
-		return err
+	var err error
+	if connected {
+		if err = c.channel.Close(); err == nil {
+			err = c.conn.Close()
+		}
 	}
-	if err := c.conn.Close(); err != nil {
-		return err
+
+	// Stop consumers
+	c.forwarders.Wait()
+	c.Lock()
+	for queue, res := range c.consumers {
+		close(res)
+		delete(c.consumers, queue)
 	}
+	c.Unlock()
 
-	return nil
+	return err
 }
 
 // METRIC MESSAGE METHODS:
 
 func (m *RabbitMQMetricMessage) unmarshalIfNeeded() error {
-	return json.Unmarshal(m.d.Body, &m.data)
+	if m.err != nil {
+		return m.err
+	}
+
+	body, encoding := m.payload()
+	body, err := decompress(encoding, body)
+	if err != nil {
+		return err
+	}
+
+	codec, err := codecFor(m.d.ContentType)
+	if err != nil {
+		return err
+	}
+	return codec.Unmarshal(body, &m.data)
+}
+
+// payload returns the body of this metric and its content encoding
+func (m *RabbitMQMetricMessage) payload() ([]byte, string) {
+	if m.batch != nil {
+		return m.body, ""
+	}
+	return m.d.Body, m.d.ContentEncoding
 }
 
 // MetricData in the metric
@@ -154,12 +552,111 @@ func (m *RabbitMQMetricMessage) MetricData() (MetricData, error) {
 	return m.data, err
 }
 
+// DeliveryTag of the delivery carrying the metric, shared by all metrics
+// packed in the same delivery
+func (m *RabbitMQMetricMessage) DeliveryTag() uint64 {
+	return m.d.DeliveryTag
+}
+
 // Ack acknowledges metric processed (and stored) correctly
 func (m *RabbitMQMetricMessage) Ack() error {
+	if m.batch != nil {
+		return m.batch.settle(true)
+	}
 	return m.d.Ack(false)
 }
 
+// requeue the delivery using the broker, used when republishing fails
+func (m *RabbitMQMetricMessage) requeue() error {
+	if m.batch != nil {
+		return m.batch.settle(false)
+	}
+	return m.d.Nack(false, true)
+}
+
 // Nack negatively acknowledges the message, forcing requeuing
+// The message is published again to its queue with an increased retries
+// header, then acked
 func (m *RabbitMQMetricMessage) Nack() error {
-	return m.d.Nack(false, true)
+	headers := m.headers()
+	headers[RetriesHeader] = int32(m.retries() + 1)
+
+	return m.republish("", m.queue, headers)
+}
+
+// Requeue the message without increasing its retries header
+// The message is published again to its queue as it is, then acked
+func (m *RabbitMQMetricMessage) Requeue() error {
+	return m.republish("", m.queue, m.headers())
+}
+
+// Reject the message, sending it to the dead-letter queue
+func (m *RabbitMQMetricMessage) Reject() error {
+	m.channel.Lock()
+	dlx, ok := m.channel.deadLetters[m.queue]
+	m.channel.Unlock()
+	if !ok {
+		m.requeue()
+		return fmt.Errorf("No dead-letter exchange declared for queue '%s'", m.queue)
+	}
+
+	return m.republish(dlx, m.queue, m.headers())
+}
+
+// headers returns a copy of the delivery headers, without batch ones
+func (m *RabbitMQMetricMessage) headers() amqp.Table {
+	headers := amqp.Table{}
+	for k, v := range m.d.Headers {
+		headers[k] = v
+	}
+	if m.batch != nil {
+		delete(headers, BatchSizeHeader)
+	}
+	return headers
+}
+
+// republish a copy of the message and ack the original once the broker
+// confirms the copy, if publishing fails the original is requeued by the
+// broker instead
+func (m *RabbitMQMetricMessage) republish(exchange, key string, headers amqp.Table) error {
+	body, encoding := m.payload()
+	err := m.channel.publishConfirmed(exchange, key, amqp.Publishing{
+		Headers:         headers,
+		DeliveryMode:    amqp.Persistent,
+		ContentType:     m.d.ContentType,
+		ContentEncoding: encoding,
+		Timestamp:       m.d.Timestamp,
+		Body:            body,
+	})
+	if err != nil {
+		m.requeue()
+		return err
+	}
+	return m.Ack()
+}
+
+// Attempts returns the delivery attempt of this message, 1 the first time
+func (m *RabbitMQMetricMessage) Attempts() int {
+	return m.retries() + 1
+}
+
+func (m *RabbitMQMetricMessage) retries() int {
+	retries, _ := intHeader(m.d.Headers, RetriesHeader)
+	return retries
+}
+
+// intHeader returns the value of an integer header and whether it was present
+func intHeader(headers amqp.Table, name string) (int, bool) {
+	switch v := headers[name].(type) {
+	case int32:
+		return int(v), true
+	case int64:
+		return int(v), true
+	case int16:
+		return int(v), true
+	case int8:
+		return int(v), true
+	default:
+		return 0, false
+	}
 }
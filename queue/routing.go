@@ -0,0 +1,91 @@
+package queue
+
+import (
+	"errors"
+	"strings"
+)
+
+// Exchange types
+const (
+	// Fanout exchanges route every metric to all bound queues
+	Fanout = "fanout"
+
+	// Direct exchanges route metrics to queues bound with their exact routing key
+	Direct = "direct"
+
+	// Topic exchanges route metrics to queues bound with a matching pattern,
+	// where `*` matches a word and `#` zero or more words
+	Topic = "topic"
+)
+
+// RoutingKey returns the routing key for a metric: its name split in words
+// (on '_' and '.'), followed by the values of the given tags. For instance
+// `kite_call` with tag `region: eu` gives `kite.call.eu`
+func RoutingKey(d *MetricData, tags ...string) string {
+	words := strings.FieldsFunc(d.Metric, func(r rune) bool {
+		return r == '_' || r == '.'
+	})
+
+	for _, tag := range tags {
+		value, ok := d.Tags[tag]
+		if !ok || value == "" {
+			value = "none"
+		}
+		words = append(words, strings.Replace(value, ".", "_", -1))
+	}
+
+	return strings.Join(words, ".")
+}
+
+// ErrNoBindings is returned when declaring a queue without bindings on a
+// direct exchange, as it would receive no metrics
+var ErrNoBindings = errors.New("Queues of a direct exchange need bindings")
+
+// queueBindings returns the bindings of a queue in an exchange of the given
+// type, when none are given: all metrics for fanout and topic exchanges,
+// failing with ErrNoBindings for direct ones
+func queueBindings(kind string, bindings []string) ([]string, error) {
+	if len(bindings) > 0 {
+		return bindings, nil
+	}
+	switch kind {
+	case Direct:
+		return nil, ErrNoBindings
+	case Topic:
+		return []string{"#"}, nil
+	}
+	return []string{""}, nil
+}
+
+// routes returns true if a metric with the given routing key is routed to a
+// queue bound with pattern in an exchange of the given type
+func routes(kind, pattern, key string) bool {
+	switch kind {
+	case Fanout:
+		return true
+	case Topic:
+		return topicMatch(strings.Split(pattern, "."), strings.Split(key, "."))
+	default:
+		return pattern == key
+	}
+}
+
+func topicMatch(pattern, key []string) bool {
+	if len(pattern) == 0 {
+		return len(key) == 0
+	}
+
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(key); i++ {
+			if topicMatch(pattern[1:], key[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(key) > 0 && topicMatch(pattern[1:], key[1:])
+	default:
+		return len(key) > 0 && pattern[0] == key[0] && topicMatch(pattern[1:], key[1:])
+	}
+}
@@ -0,0 +1,101 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRoutingKey(t *testing.T) {
+	var tests = []struct {
+		data MetricData
+		tags []string
+		key  string
+	}{
+		{MetricData{Metric: "kite_call"}, nil, "kite.call"},
+		{MetricData{Metric: "kite.call_count"}, nil, "kite.call.count"},
+		{MetricData{Metric: "kite_call", Tags: map[string]string{"region": "eu.west"}}, []string{"region"}, "kite.call.eu_west"},
+		{MetricData{Metric: "kite_call"}, []string{"region"}, "kite.call.none"},
+	}
+
+	for _, v := range tests {
+		if key := RoutingKey(&v.data, v.tags...); key != v.key {
+			t.Errorf("Wrong routing key for %#v: %s (%s expected)", v.data, key, v.key)
+		}
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	var tests = []struct {
+		kind, pattern, key string
+		routes             bool
+	}{
+		{Fanout, "", "kite.call", true},
+		{Direct, "kite.call", "kite.call", true},
+		{Direct, "kite.call", "kite.other", false},
+		{Topic, "#", "kite.call", true},
+		{Topic, "kite.#", "kite", true},
+		{Topic, "kite.#", "kite.call.count", true},
+		{Topic, "kite.*", "kite.call", true},
+		{Topic, "kite.*", "kite.call.count", false},
+		{Topic, "*.call", "kite.call", true},
+		{Topic, "#.count", "kite.call.count", true},
+		{Topic, "kite.#", "other.call", false},
+	}
+
+	for _, v := range tests {
+		if r := routes(v.kind, v.pattern, v.key); r != v.routes {
+			t.Errorf("%s exchange, binding '%s', key '%s': got %t, expected %t",
+				v.kind, v.pattern, v.key, r, v.routes)
+		}
+	}
+}
+
+func TestDirectQueueNeedsBindings(t *testing.T) {
+	channel := Dummy()
+	channel.DeclareExchange("foo", Direct, true)
+	if err := channel.DeclareQueue("foo", "none", true); err != ErrNoBindings {
+		t.Errorf("Expected ErrNoBindings, got %v", err)
+	}
+	if err := channel.DeclareQueue("foo", "kite", true, "kite.call"); err != nil {
+		t.Error("Declaring queue with bindings", err)
+	}
+}
+
+func TestDummyTopicRouting(t *testing.T) {
+	channel := Dummy()
+	channel.DeclareExchange("foo", Topic, true)
+	channel.DeclareQueue("foo", "kite", true, "kite.#")
+	channel.DeclareQueue("foo", "all", true)
+	kite, _ := channel.ConsumeMetrics("kite", 1)
+	all, _ := channel.ConsumeMetrics("all", 1)
+
+	channel.PublishMetric("foo", &MetricData{Username: "user", Metric: "kite_call"})
+	channel.PublishMetric("foo", &MetricData{Username: "user", Metric: "other_call"})
+
+	for _, expected := range []string{"kite_call", "other_call"} {
+		select {
+		case m := <-all:
+			if data, _ := m.MetricData(); data.Metric != expected {
+				t.Errorf("Expected %s in 'all' queue, got %s", expected, data.Metric)
+			}
+		case <-time.After(100 * time.Millisecond):
+			t.Errorf("Metric %s not routed to 'all' queue", expected)
+		}
+	}
+
+	select {
+	case m := <-kite:
+		if data, _ := m.MetricData(); data.Metric != "kite_call" {
+			t.Errorf("Unexpected metric in 'kite' queue: %s", data.Metric)
+		}
+	default:
+		t.Error("Metric not routed to 'kite' queue")
+	}
+
+	select {
+	case m := <-kite:
+		data, _ := m.MetricData()
+		t.Errorf("Unexpected metric in 'kite' queue: %s", data.Metric)
+	default:
+	}
+}
@@ -0,0 +1,33 @@
+package queue
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ValidationError is returned when a metric doesn't follow the expected schema
+type ValidationError struct {
+	// Field that failed validation
+	Field string
+	// Reason why it failed
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("Invalid metric %s: %s", e.Field, e.Reason)
+}
+
+// Validate checks MetricData has all the required fields, it returns a
+// *ValidationError otherwise
+func (d *MetricData) Validate() error {
+	if strings.TrimSpace(d.Username) == "" {
+		return &ValidationError{Field: "username", Reason: "must not be empty"}
+	}
+	if strings.TrimSpace(d.Metric) == "" {
+		return &ValidationError{Field: "metric", Reason: "must not be empty"}
+	}
+	if d.Count < 0 {
+		return &ValidationError{Field: "count", Reason: fmt.Sprintf("must not be negative (%d)", d.Count)}
+	}
+	return nil
+}
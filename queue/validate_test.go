@@ -0,0 +1,36 @@
+package queue
+
+import "testing"
+
+func TestValidate(t *testing.T) {
+	var tests = []struct {
+		data  MetricData
+		field string
+	}{
+		{MetricData{Username: "user", Count: 1, Metric: "metric"}, ""},
+		{MetricData{Username: "user", Count: 0, Metric: "metric"}, ""},
+		{MetricData{Username: "", Count: 1, Metric: "metric"}, "username"},
+		{MetricData{Username: "  ", Count: 1, Metric: "metric"}, "username"},
+		{MetricData{Username: "user", Count: 1, Metric: ""}, "metric"},
+		{MetricData{Username: "user", Count: -1, Metric: "metric"}, "count"},
+	}
+
+	for _, v := range tests {
+		err := v.data.Validate()
+		if v.field == "" {
+			if err != nil {
+				t.Errorf("Unexpected error validating %#v: %s", v.data, err)
+			}
+			continue
+		}
+
+		verr, ok := err.(*ValidationError)
+		if !ok {
+			t.Errorf("Expected ValidationError for %#v, got %#v", v.data, err)
+			continue
+		}
+		if verr.Field != v.field {
+			t.Errorf("Wrong field for %#v: %s (%s expected)", v.data, verr.Field, v.field)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/exekias/metric-collector/api"
+	"github.com/exekias/metric-collector/config"
+	"github.com/exekias/metric-collector/logging"
+	"github.com/exekias/metric-collector/workers"
+	"github.com/exekias/metric-collector/workers/accountname"
+	"github.com/exekias/metric-collector/workers/distinctname"
+	"github.com/exekias/metric-collector/workers/hourlylog"
+)
+
+// queryable processors, whose data can be served
+var queryable = []string{"accountname", "distinctname", "hourlylog"}
+
+// serveCommand runs `serve`, answering queries over the data stored by the
+// given processors (all queryable ones by default) until SIGINT/SIGTERM
+func serveCommand(cfg *config.Config, processors []string) {
+	if len(processors) == 0 {
+		processors = queryable
+	}
+	if err := cfg.Validate(processors...); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	cfg.ConfigureLogging()
+
+	var server api.Server
+	var readers []io.Closer
+	for _, name := range processors {
+		log.Infof("Initializing '%s' reader", name)
+		factory, _ := workers.Lookup(name)
+		settings, _ := workers.Resolve(factory.Settings, cfg.Processors[name])
+
+		var err error
+		switch name {
+		case "hourlylog":
+			var r *hourlylog.Reader
+			if r, err = hourlylog.NewReader(settings.Get("MONGO_URL"), settings.Get("MONGO_DATABASE"), settings.Get("MONGO_COLLECTION")); err == nil {
+				server.Events = r
+				readers = append(readers, r)
+			}
+		case "distinctname":
+			var r *distinctname.Reader
+			var opts distinctname.Options
+			if opts, err = distinctname.ParseOptions(settings); err != nil {
+				break
+			}
+			if r, err = distinctname.NewReader(settings.Get("REDIS_URL"), opts); err == nil {
+				server.Top = r
+				server.Users = r
+				server.Location = r.Location()
+				readers = append(readers, r)
+			}
+		case "accountname":
+			var r *accountname.Reader
+			if r, err = accountname.NewReader(settings.Get("POSTGRES_URL")); err == nil {
+				server.Accounts = r
+				readers = append(readers, r)
+			}
+		default:
+			err = fmt.Errorf("Processor '%s' data can't be queried", name)
+		}
+		if err != nil {
+			log.Fatalf("Error initializing reader: %s", err)
+		}
+	}
+
+	// Log levels are only changed from the stats listener, never the public API
+	listen := cfg.Stats.Listen
+	log.Infof("Serving stats in %s/debug/vars and log levels in %s/debug/log", listen, listen)
+	http.Handle("/debug/log", logging.Handler())
+	go func() {
+		if err := http.ListenAndServe(listen, nil); err != nil {
+			log.Errorf("Could not serve stats: %s", err)
+		}
+	}()
+
+	mux := http.NewServeMux()
+	server.Register(mux)
+	srv := &http.Server{Addr: cfg.API.Listen, Handler: mux}
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		log.Infof("Received %s, shutting down", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	log.Infof("Serving the API in %s/api/v1/", cfg.API.Listen)
+	err := srv.ListenAndServe()
+	for _, r := range readers {
+		r.Close()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatalf("Could not serve the API: %s", err)
+	}
+}
@@ -5,9 +5,18 @@ import "time"
 // ExponentialBackoff returns function that while sleep for a time
 // doubling it each time it's called
 func ExponentialBackoff(duration time.Duration) func() {
+	return ExponentialBackoffMax(duration, 0)
+}
+
+// ExponentialBackoffMax works like ExponentialBackoff but never sleeps
+// longer than max (0 means no limit)
+func ExponentialBackoffMax(duration, max time.Duration) func() {
 	d := duration
 	return func() {
 		time.Sleep(d)
 		d = d * 2
+		if max > 0 && d > max {
+			d = max
+		}
 	}
 }
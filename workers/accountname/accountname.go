@@ -2,7 +2,6 @@ package accountname
 
 import (
 	"database/sql"
-	"fmt"
 
 	// PostgreSQL driver
 	_ "github.com/lib/pq"
@@ -24,10 +23,10 @@ type AccountName struct {
 func NewAccountName(url string) (*AccountName, error) {
 	var processor AccountName
 
-	log.Debug(fmt.Sprintf("Connecting to PostgreSQL (%s)", url))
+	log.Debugf("Connecting to PostgreSQL (%s)", url)
 	db, err := sql.Open("postgres", url)
 	if err != nil {
-		log.Error("Error connecting to PostgreSQL:", err)
+		log.Errorf("Error connecting to PostgreSQL: %s", err)
 		return nil, err
 	}
 	processor.db = db
@@ -41,14 +40,18 @@ func NewAccountName(url string) (*AccountName, error) {
         );
     `)
 	if err != nil {
-		log.Error("Could not create metrics table:", err)
+		log.Errorf("Could not create metrics table: %s", err)
 		return nil, err
 	}
 
-	// Insert if new, do nothing if username is already inserted
-	stmt, err := db.Prepare("INSERT INTO metrics (username) VALUES ($1) ON CONFLICT DO NOTHING")
+	// Insert if new, keep the earliest event time if username is already
+	// inserted (events may arrive out of order)
+	stmt, err := db.Prepare(`
+        INSERT INTO metrics (username, time) VALUES ($1, $2)
+        ON CONFLICT (username) DO UPDATE SET time = LEAST(metrics.time, EXCLUDED.time)
+    `)
 	if err != nil {
-		log.Error("Error preparing statement")
+		log.Errorf("Error preparing statement: %s", err)
 		return nil, err
 	}
 	processor.stmt = stmt
@@ -58,10 +61,28 @@ func NewAccountName(url string) (*AccountName, error) {
 
 // Process data from the queue
 func (a AccountName) Process(d queue.MetricData) error {
-	_, err := a.stmt.Exec(d.Username)
+	_, err := a.stmt.Exec(d.Username, d.EventTime().UTC())
 	if err != nil {
-		log.Error("Error inserting user in the database:", err)
+		log.Errorf("Error inserting user in the database: %s", err)
 		return err
 	}
 	return nil
 }
+
+// Check the PostgreSQL connection
+func (a AccountName) Check() error {
+	return a.db.Ping()
+}
+
+// Concurrency hint, upserts are independent so we can go wide
+func (a AccountName) Concurrency() int {
+	return 16
+}
+
+// Close the PostgreSQL connection
+func (a AccountName) Close() error {
+	if err := a.stmt.Close(); err != nil {
+		return err
+	}
+	return a.db.Close()
+}
@@ -0,0 +1,79 @@
+package accountname
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/exekias/metric-collector/api"
+)
+
+// Reader queries the accounts stored by AccountName, implements
+// api.AccountReader
+type Reader struct {
+	db *sql.DB
+}
+
+// NewReader connects to the PostgreSQL database AccountName writes to
+func NewReader(url string) (*Reader, error) {
+	log.Debugf("Connecting to PostgreSQL (%s)", url)
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		log.Errorf("Error connecting to PostgreSQL: %s", err)
+		return nil, err
+	}
+	return &Reader{db: db}, nil
+}
+
+// Accounts returns the accounts matching the query, oldest first
+func (r *Reader) Accounts(q api.AccountQuery) ([]api.Account, error) {
+	var where []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if len(q.Usernames) > 0 {
+		names := make([]string, len(q.Usernames))
+		for i, u := range q.Usernames {
+			names[i] = arg(u)
+		}
+		where = append(where, "username IN ("+strings.Join(names, ", ")+")")
+	}
+	// Times are stored in UTC, without time zone
+	if !q.From.IsZero() {
+		where = append(where, "time >= "+arg(q.From.UTC()))
+	}
+	if !q.To.IsZero() {
+		where = append(where, "time < "+arg(q.To.UTC()))
+	}
+
+	query := "SELECT username, time FROM metrics"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY time, username LIMIT " + arg(q.Limit)
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accounts []api.Account
+	for rows.Next() {
+		var a api.Account
+		if err := rows.Scan(&a.Username, &a.FirstSeen); err != nil {
+			return nil, err
+		}
+		a.FirstSeen = a.FirstSeen.UTC()
+		accounts = append(accounts, a)
+	}
+	return accounts, rows.Err()
+}
+
+// Close the PostgreSQL connection
+func (r *Reader) Close() error {
+	return r.db.Close()
+}
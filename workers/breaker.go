@@ -0,0 +1,257 @@
+package workers
+
+import (
+	"context"
+	"expvar"
+	"sync"
+	"time"
+)
+
+// Breaker states
+const (
+	// BreakerClosed lets all metrics trough
+	BreakerClosed = "closed"
+
+	// BreakerOpen stops consuming metrics until the open timeout expires
+	BreakerOpen = "open"
+
+	// BreakerHalfOpen lets a single trial metric trough, closing the
+	// breaker if it succeeds
+	BreakerHalfOpen = "half-open"
+)
+
+var (
+	breakerStates      = expvar.NewMap("breaker_state")       // by queue
+	breakerTransitions = expvar.NewMap("breaker_transitions") // by queue
+)
+
+// BreakerOptions configure the circuit breaker around a processor, zero
+// fields take the value in DefaultBreakerOptions
+type BreakerOptions struct {
+	// FailureRate (0-1) in the window opening the breaker
+	FailureRate float64
+
+	// Window is the number of latest results the failure rate is computed on
+	Window int
+
+	// MinResults in the window before the breaker can open
+	MinResults int
+
+	// OpenTimeout is the time the breaker stays open before a trial, it
+	// doubles after each failed trial up to MaxOpenTimeout
+	OpenTimeout    time.Duration
+	MaxOpenTimeout time.Duration
+}
+
+// DefaultBreakerOptions for RunWorker
+var DefaultBreakerOptions = BreakerOptions{
+	FailureRate:    0.5,
+	Window:         20,
+	MinResults:     10,
+	OpenTimeout:    5 * time.Second,
+	MaxOpenTimeout: time.Minute,
+}
+
+func (o BreakerOptions) withDefaults() BreakerOptions {
+	if o.FailureRate <= 0 {
+		o.FailureRate = DefaultBreakerOptions.FailureRate
+	}
+	if o.Window <= 0 {
+		o.Window = DefaultBreakerOptions.Window
+	}
+	if o.MinResults <= 0 {
+		o.MinResults = DefaultBreakerOptions.MinResults
+	}
+	if o.MinResults > o.Window {
+		o.MinResults = o.Window
+	}
+	if o.OpenTimeout <= 0 {
+		o.OpenTimeout = DefaultBreakerOptions.OpenTimeout
+	}
+	if o.MaxOpenTimeout < o.OpenTimeout {
+		o.MaxOpenTimeout = o.OpenTimeout
+	}
+	return o
+}
+
+// breaker is a circuit breaker fed with processing results. While open the
+// worker stops consuming, so metrics stay in the broker until the backend
+// recovers
+type breaker struct {
+	sync.Mutex
+	name string
+	opts BreakerOptions
+
+	state string
+	// results ring buffer, true = failure
+	results  []bool
+	next     int
+	count    int
+	failures int
+
+	// when the breaker is open, until and current timeout
+	until   time.Time
+	timeout time.Duration
+	// a trial metric is being processed (half-open)
+	probing bool
+
+	// closed and replaced on every state change, or when the trial is
+	// released
+	changed chan struct{}
+}
+
+func newBreaker(name string, opts BreakerOptions) *breaker {
+	opts = opts.withDefaults()
+	b := &breaker{
+		name:    name,
+		opts:    opts,
+		results: make([]bool, opts.Window),
+		timeout: opts.OpenTimeout,
+		changed: make(chan struct{}),
+	}
+	b.setState(BreakerClosed)
+	return b
+}
+
+// State of the breaker
+func (b *breaker) State() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.state
+}
+
+// wait blocks until a metric can be processed, ok is false if ctx is done
+// first. In half-open state only one caller is let trough, with trial set,
+// until its result is recorded
+func (b *breaker) wait(ctx context.Context) (trial, ok bool) {
+	for {
+		b.Lock()
+		if b.state == BreakerOpen && !time.Now().Before(b.until) {
+			b.setState(BreakerHalfOpen)
+		}
+
+		switch {
+		case b.state == BreakerClosed:
+			b.Unlock()
+			return false, true
+		case b.state == BreakerHalfOpen && !b.probing:
+			b.probing = true
+			b.Unlock()
+			return true, true
+		}
+
+		changed := b.changed
+		var expired <-chan time.Time
+		if b.state == BreakerOpen {
+			expired = time.After(b.until.Sub(time.Now()))
+		}
+		b.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return false, false
+		case <-changed:
+		case <-expired:
+		}
+	}
+}
+
+// record the result of processing a metric, trial if wait let it trough as
+// such. Returns true if it failed during an outage: while the breaker was not
+// closed or opening it. Those failures are blamed on the backend rather than
+// on the metric
+func (b *breaker) record(trial, success bool) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	switch b.state {
+	case BreakerHalfOpen:
+		if !trial {
+			// Dispatched before opening, only the trial decides
+			return !success
+		}
+		b.probing = false
+		if success {
+			log.Infof("Trial metric for '%s' succeeded, resuming", b.name)
+			b.timeout = b.opts.OpenTimeout
+			b.reset()
+			b.setState(BreakerClosed)
+			return false
+		}
+		b.timeout *= 2
+		if b.timeout > b.opts.MaxOpenTimeout {
+			b.timeout = b.opts.MaxOpenTimeout
+		}
+		b.open()
+		return true
+
+	case BreakerClosed:
+		if b.count == len(b.results) && b.results[b.next] {
+			b.failures--
+		}
+		b.results[b.next] = !success
+		b.next = (b.next + 1) % len(b.results)
+		if b.count < len(b.results) {
+			b.count++
+		}
+		if !success {
+			b.failures++
+		}
+
+		if b.count >= b.opts.MinResults && float64(b.failures)/float64(b.count) >= b.opts.FailureRate {
+			b.open()
+			return !success
+		}
+		return false
+
+	default:
+		// Metrics dispatched before opening, ignore them
+		return !success
+	}
+}
+
+// release the trial metric without a result, ie. when it was invalid, so the
+// next metric becomes the trial. Other metrics are ignored
+func (b *breaker) release(trial bool) {
+	b.Lock()
+	defer b.Unlock()
+	if trial && b.state == BreakerHalfOpen {
+		b.probing = false
+		b.notify()
+	}
+}
+
+// open the breaker for the current timeout, must hold the lock
+func (b *breaker) open() {
+	log.Warningf("Too many errors processing '%s' metrics, pausing consumption for %s", b.name, b.timeout)
+	b.until = time.Now().Add(b.timeout)
+	b.setState(BreakerOpen)
+}
+
+// reset the results window, must hold the lock
+func (b *breaker) reset() {
+	for i := range b.results {
+		b.results[i] = false
+	}
+	b.next, b.count, b.failures = 0, 0, 0
+}
+
+// setState changes the state, notifying waiters, must hold the lock
+func (b *breaker) setState(state string) {
+	if b.state != "" {
+		log.Infof("Circuit breaker for '%s': %s -> %s", b.name, b.state, state)
+		breakerTransitions.Add(b.name, 1)
+	}
+	b.state = state
+
+	s := new(expvar.String)
+	s.Set(state)
+	breakerStates.Set(b.name, s)
+	b.notify()
+}
+
+// notify waiters of a change, must hold the lock
+func (b *breaker) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
@@ -0,0 +1,82 @@
+package workers
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBreakerOpensOnFailureRate(t *testing.T) {
+	b := newBreaker("test_rate", BreakerOptions{FailureRate: 0.5, Window: 4, MinResults: 4})
+
+	b.record(false, true)
+	if b.record(false, false) {
+		t.Error("Failures while closed should be blamed on the metric")
+	}
+	b.record(false, true)
+	if b.State() != BreakerClosed {
+		t.Fatalf("Breaker should be closed before MinResults, got %s", b.State())
+	}
+
+	if !b.record(false, false) {
+		t.Error("The failure opening the breaker should be blamed on the outage")
+	}
+	if b.State() != BreakerOpen {
+		t.Fatalf("Breaker should open at 50%% failures, got %s", b.State())
+	}
+	if !b.record(false, false) {
+		t.Error("Failures while open should be blamed on the outage")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, ok := b.wait(ctx); ok {
+		t.Error("Open breaker should not let metrics trough")
+	}
+}
+
+func TestBreakerHalfOpenTrial(t *testing.T) {
+	b := newBreaker("test_trial", BreakerOptions{Window: 1, OpenTimeout: 10 * time.Millisecond})
+	b.record(false, false)
+	if b.State() != BreakerOpen {
+		t.Fatalf("Breaker should be open, got %s", b.State())
+	}
+
+	// Only one trial is let trough after the timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if trial, ok := b.wait(ctx); !ok || !trial {
+		t.Fatal("Breaker did not let a trial metric trough")
+	}
+	if b.State() != BreakerHalfOpen {
+		t.Fatalf("Breaker should be half-open, got %s", b.State())
+	}
+
+	waited := make(chan bool)
+	go func() {
+		trial, ok := b.wait(ctx)
+		waited <- ok && !trial
+	}()
+	select {
+	case <-waited:
+		t.Fatal("Breaker let a second metric trough while half-open")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// Metrics dispatched before opening don't decide the trial
+	if !b.record(false, false) || b.record(false, true) {
+		t.Error("Results of other metrics while half-open should be blamed on the outage")
+	}
+	if b.State() != BreakerHalfOpen {
+		t.Fatalf("Breaker should stay half-open until the trial finishes, got %s", b.State())
+	}
+
+	// Trial succeeds, resume
+	b.record(true, true)
+	if !<-waited {
+		t.Error("Breaker did not resume after a successful trial")
+	}
+	if b.State() != BreakerClosed {
+		t.Errorf("Breaker should be closed, got %s", b.State())
+	}
+}
@@ -0,0 +1,424 @@
+package distinctname
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"gopkg.in/redis.v3"
+)
+
+// Consolidation defaults
+const (
+	// DefaultGrace is the time after a period ends its late events are still
+	// counted in the finer sets, before rolling them up
+	DefaultGrace = time.Hour
+
+	// lockKey guards consolidation, so only one replica runs it at a time
+	lockKey = "metrics:dn:lock:consolidate"
+	lockTTL = time.Minute
+
+	// retryInterval after a failed rollup
+	retryInterval = time.Minute
+)
+
+// consolidateScript merges the finer sets (KEYS[3..]) into the coarser one
+// (KEYS[1]), expires them and records it in the status hash (KEYS[2]), all
+// at once. Unless forced it does nothing if the period was already
+// consolidated, forcing rebuilds the coarser set from the finer ones only.
+// ARGV: consolidation time (RFC 3339), instance, force and keep finer sets
+// ("1" or "0"), aggregate of the mode (SUM, MAX or MIN), expiration of the
+// coarser set (unix time, empty if none), then the expiration of each finer
+// set.
+// Returns {done, coarser set members before, after, finer sets merged}, done
+// is -1 when forced without finer sets to rebuild from
+var consolidateScript = redis.NewScript(`
+local force, keep = ARGV[3] == "1", ARGV[4] == "1"
+local before = redis.call("ZCARD", KEYS[1])
+if not force and redis.call("EXISTS", KEYS[2]) == 1 then
+	return {0, before, before, 0}
+end
+local sets, merged = {}, 0
+if not force then
+	sets[1] = KEYS[1]
+end
+for i = 3, #KEYS do
+	if redis.call("EXISTS", KEYS[i]) == 1 then
+		merged = merged + 1
+		sets[#sets + 1] = KEYS[i]
+	end
+end
+if merged == 0 and force then
+	return {-1, before, before, 0}
+end
+if #sets > 0 then
+	local n = #sets
+	sets[n + 1], sets[n + 2] = "AGGREGATE", ARGV[5]
+	redis.call("ZUNIONSTORE", KEYS[1], n, unpack(sets))
+end
+if ARGV[6] ~= "" then
+	redis.call("EXPIREAT", KEYS[1], ARGV[6])
+end
+if not keep then
+	for i = 3, #KEYS do
+		if ARGV[i + 4] ~= "" then
+			redis.call("EXPIREAT", KEYS[i], ARGV[i + 4])
+		end
+	end
+end
+local after = redis.call("ZCARD", KEYS[1])
+redis.call("HMSET", KEYS[2],
+	"consolidated_at", ARGV[1],
+	"instance", ARGV[2],
+	"merged", merged,
+	"metrics", after,
+	"forced", ARGV[3],
+	"kept", ARGV[4])
+return {1, before, after, merged}
+`)
+
+// updateLua defines update(set), which counts an event in set. ARGV are the
+// metric, the value of the event and the mode
+const updateLua = `
+local function update(set)
+	local metric, value, mode = ARGV[1], tonumber(ARGV[2]), ARGV[3]
+	if mode == "max" or mode == "min" then
+		local current = tonumber(redis.call("ZSCORE", set, metric))
+		if current and ((mode == "max" and current >= value) or (mode == "min" and current <= value)) then
+			return
+		end
+		redis.call("ZADD", set, value, metric)
+	else
+		redis.call("ZINCRBY", set, value, metric)
+	end
+end
+`
+
+// updateScript counts an event in KEYS[1], see updateLua
+var updateScript = redis.NewScript(updateLua + `
+update(KEYS[1])
+return 1
+`)
+
+// lateScript counts an event in the coarsest set already rolled up for its
+// time, see updateLua. It's also counted in the finer sets still there (kept
+// or not expired yet), so forcing their rollup doesn't lose it. KEYS are the
+// set of the finest tier, then pairs of set and status of each coarser tier
+var lateScript = redis.NewScript(updateLua + `
+local set, finer = KEYS[1], {}
+for i = 2, #KEYS, 2 do
+	if redis.call("EXISTS", KEYS[i + 1]) == 0 then
+		break
+	end
+	finer[#finer + 1] = set
+	set = KEYS[i]
+end
+update(set)
+for _, f in ipairs(finer) do
+	if redis.call("EXISTS", f) == 1 then
+		update(f)
+	end
+end
+return 1
+`)
+
+// rollup the last ended period of every rolled up tier, in every mode in
+// use, once their grace period is over. Returns false if any of them failed
+// or is being rolled up by another instance, so it is retried
+func (p DistinctName) rollup(now time.Time) bool {
+	ok := true
+	now = now.In(p.loc)
+	for i := 1; i < len(p.tiers); i++ {
+		tier := p.tiers[i].Tier
+		current := tier.start(now)
+		if now.Before(current.Add(p.grace)) {
+			log.Debugf("Past %s still in its grace period until %s", tier, current.Add(p.grace))
+			continue
+		}
+
+		last := tier.start(current.Add(-time.Nanosecond))
+		if err := p.rollupPeriod(i, last); err == ErrLocked {
+			// It may not finish, check again later
+			log.Debugf("Rollup of past %s running in another instance, retrying in %s", tier, retryInterval)
+			ok = false
+		} else if err != nil {
+			log.Errorf("Error rolling up past %s: %s", tier, err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// rollupPeriod consolidates the sets of every mode in use, and the unique
+// users if counted, of the period of the i-th tier starting at start. It
+// rolls up its finer periods first if they were missed
+func (p DistinctName) rollupPeriod(i int, start time.Time) error {
+	if i > 1 {
+		finer := p.tiers[i-1].Tier
+		for t := start; t.Before(p.tiers[i].Tier.next(start)); t = finer.next(t) {
+			if err := p.rollupPeriod(i-1, t); err != nil {
+				return err
+			}
+		}
+	}
+	tier := p.tiers[i].Tier
+	for _, mode := range p.modes {
+		if _, err := p.consolidate(tier, mode, start); err != nil {
+			return err
+		}
+	}
+	if p.users {
+		_, err := consolidateUsers(p.client, p.loc, p.tiers, tier, start, ConsolidateOptions{Grace: p.grace})
+		return err
+	}
+	return nil
+}
+
+// consolidate the finer sets of mode of the period of the given tier
+// containing t, returns false if it was already done. It fails with
+// ErrLocked if another instance is doing it
+func (p DistinctName) consolidate(tier Tier, mode Mode, t time.Time) (bool, error) {
+	report, err := consolidate(p.client, p.loc, p.tiers, tier, mode, t, ConsolidateOptions{Grace: p.grace})
+	return report.Consolidated, err
+}
+
+// ErrLocked is returned when another instance is consolidating
+var ErrLocked = errors.New("Consolidation running in another instance")
+
+// ErrNotEnded is returned when consolidating a period before it ends, plus
+// its grace period. Its late events would still go to the finer sets
+var ErrNotEnded = errors.New("Period not ended yet or still in its grace period")
+
+// ErrNoFinerSets is returned when forcing the consolidation of a period
+// without finer sets, which would empty its set
+var ErrNoFinerSets = errors.New("No finer sets to rebuild the set from")
+
+// ConsolidateOptions for Consolidate
+type ConsolidateOptions struct {
+	// Force rebuilding the set from the finer ones, even if the period was
+	// already consolidated. Otherwise finer sets are added to it
+	Force bool
+
+	// KeepFiner sets after merging them, instead of applying their retention
+	KeepFiner bool
+
+	// DryRun reports what would be done without changing anything
+	DryRun bool
+
+	// Grace after the period ends before it can be consolidated, see
+	// Options.Grace
+	Grace time.Duration
+}
+
+// ConsolidateReport describes a consolidation
+type ConsolidateReport struct {
+	// Set consolidated
+	Set string
+
+	// Consolidated is false if the period was already done (and not forced)
+	Consolidated bool
+
+	// Merged finer sets
+	Merged int
+
+	// Members of the set before and after
+	Before, After int64
+}
+
+// Consolidate the finer sets of mode of the period of the given tier
+// containing t (in the reporting timezone loc) into its set, see
+// ConsolidateOptions
+func Consolidate(url string, loc *time.Location, tiers Tiers, tier Tier, mode Mode, t time.Time, opts ConsolidateOptions) (ConsolidateReport, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     url,
+		Password: "",
+		DB:       0,
+	})
+	defer client.Close()
+
+	if err := client.Ping().Err(); err != nil {
+		log.Errorf("Error connecting to Redis: %s", err)
+		return ConsolidateReport{}, err
+	}
+	return consolidate(client, loc, tiers, tier, mode, t, opts)
+}
+
+// consolidation of a period, its keys are the set, its status and the finer
+// sets. expires holds the expiration (zero if none) of the set, then of each
+// finer set
+type consolidation struct {
+	keys    []string
+	expires []time.Time
+}
+
+// newConsolidation returns the consolidation of the sets of mode of the
+// period of the i-th tier starting at start
+func newConsolidation(tiers Tiers, i int, mode Mode, start time.Time) consolidation {
+	return periodConsolidation(tiers, i, start, func(tier Tier, t time.Time) string {
+		return tier.setName(mode, t)
+	})
+}
+
+// periodConsolidation returns the consolidation of the period of the i-th
+// tier starting at start, name returns the key of each period
+func periodConsolidation(tiers Tiers, i int, start time.Time, name func(Tier, time.Time) string) consolidation {
+	coarse, fine := tiers[i], tiers[i-1]
+	set := name(coarse.Tier, start)
+	c := consolidation{keys: []string{set, statusName(set)}}
+
+	// Only the coarsest tier expires when created, others when rolled up
+	if i == len(tiers)-1 {
+		c.expires = append(c.expires, coarse.expireAt(start))
+	} else {
+		c.expires = append(c.expires, time.Time{})
+	}
+
+	for t := start; t.Before(coarse.Tier.next(start)); t = fine.Tier.next(t) {
+		c.keys = append(c.keys, name(fine.Tier, t))
+		c.expires = append(c.expires, fine.expireAt(t))
+	}
+	return c
+}
+
+// rolledUpPeriod returns the index of tier and the start of its period
+// containing t, it fails if the tier is not rolled up or the period hasn't
+// ended grace before now
+func rolledUpPeriod(loc *time.Location, tiers Tiers, tier Tier, t, now time.Time, grace time.Duration) (int, time.Time, error) {
+	i := tiers.index(tier)
+	if i < 1 {
+		return i, t, fmt.Errorf("Tier '%s' is not rolled up, enabled tiers are %s", tier, tiers)
+	}
+	start := tier.start(t.In(loc))
+	if now.Before(tier.next(start).Add(grace)) {
+		return i, start, ErrNotEnded
+	}
+	return i, start, nil
+}
+
+func consolidate(client *redis.Client, loc *time.Location, tiers Tiers, tier Tier, mode Mode, t time.Time, opts ConsolidateOptions) (ConsolidateReport, error) {
+	i, start, err := rolledUpPeriod(loc, tiers, tier, t, time.Now(), opts.Grace)
+	if err != nil {
+		return ConsolidateReport{}, err
+	}
+	c := newConsolidation(tiers, i, mode, start)
+
+	if opts.DryRun {
+		return dryConsolidate(client, c.keys, opts)
+	}
+	return c.run(client, consolidateScript, opts, modeAggregates[mode])
+}
+
+// run script over the consolidation, holding the consolidation lock. Its
+// ARGV are those of consolidateScript, with the extra ones after the options
+func (c consolidation) run(client *redis.Client, script *redis.Script, opts ConsolidateOptions, extra ...string) (ConsolidateReport, error) {
+	report := ConsolidateReport{Set: c.keys[0]}
+	lock, err := acquire(client, lockKey, lockTTL)
+	if err != nil {
+		return report, err
+	}
+	if lock == nil {
+		return report, ErrLocked
+	}
+	defer func() {
+		if err := lock.release(); err != nil {
+			log.Warningf("Could not release consolidation lock: %s", err)
+		}
+	}()
+
+	hostname, _ := os.Hostname()
+	args := []string{
+		time.Now().UTC().Format(time.RFC3339),
+		hostname + ":" + strconv.Itoa(os.Getpid()),
+		luaBool(opts.Force),
+		luaBool(opts.KeepFiner),
+	}
+	args = append(args, extra...)
+	for _, at := range c.expires {
+		if at.IsZero() {
+			args = append(args, "")
+		} else {
+			args = append(args, strconv.FormatInt(at.Unix(), 10))
+		}
+	}
+
+	res, err := script.Run(client, c.keys, args).Result()
+	if err != nil {
+		return report, err
+	}
+
+	values, _ := res.([]interface{})
+	if len(values) != 4 {
+		return report, fmt.Errorf("Unexpected consolidation result: %v", res)
+	}
+	done, _ := values[0].(int64)
+	report.Before, _ = values[1].(int64)
+	report.After, _ = values[2].(int64)
+	merged, _ := values[3].(int64)
+	report.Merged = int(merged)
+
+	switch done {
+	case -1:
+		return report, ErrNoFinerSets
+	case 0:
+		log.Debugf("%s was already consolidated, nothing to do", report.Set)
+	default:
+		report.Consolidated = true
+		log.Infof("Consolidated %d sets into %s, %d metrics (%d before)", report.Merged, report.Set, report.After, report.Before)
+	}
+	return report, nil
+}
+
+// dryConsolidate computes the report of consolidating the given keys (see
+// newConsolidation) without changing them
+func dryConsolidate(client *redis.Client, keys []string, opts ConsolidateOptions) (ConsolidateReport, error) {
+	report := ConsolidateReport{Set: keys[0]}
+	var err error
+	if report.Before, err = client.ZCard(keys[0]).Result(); err != nil {
+		return report, err
+	}
+	report.After = report.Before
+
+	consolidated, err := client.Exists(keys[1]).Result()
+	if err != nil || (consolidated && !opts.Force) {
+		return report, err
+	}
+
+	members := make(map[string]bool)
+	if !opts.Force {
+		zs, err := client.ZRangeWithScores(keys[0], 0, -1).Result()
+		if err != nil {
+			return report, err
+		}
+		for _, z := range zs {
+			members[member(z)] = true
+		}
+	}
+	for _, set := range keys[2:] {
+		zs, err := client.ZRangeWithScores(set, 0, -1).Result()
+		if err != nil {
+			return report, err
+		}
+		if len(zs) > 0 {
+			report.Merged++
+		}
+		for _, z := range zs {
+			members[member(z)] = true
+		}
+	}
+	if report.Merged == 0 && opts.Force {
+		return report, ErrNoFinerSets
+	}
+
+	report.Consolidated = true
+	report.After = int64(len(members))
+	return report, nil
+}
+
+func luaBool(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
@@ -1,7 +1,7 @@
 package distinctname
 
 import (
-	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/exekias/metric-collector/logging"
@@ -11,16 +11,76 @@ import (
 
 var log = logging.MustGetLogger("distinctname")
 
-// DistinctName worker collects daily occurrences of distinct events in Redis.
-// Metrics that are older than 30 days are merged into a monthly bucket, then
-// cleared.
+// DistinctName worker counts occurrences of distinct events in Redis, in
+// sets of the finest tier enabled (daily by default). As periods end, their
+// sets are rolled up into the coarser tiers (monthly by default), and expired
+// after their retention. Periods are those of the reporting timezone.
+// Metrics counted in other modes (ie. summing their count) go to sets of
+// their own. Optionally, it estimates the unique users of each metric too
 type DistinctName struct {
-	client *redis.Client
+	client      *redis.Client
+	loc         *time.Location
+	grace       time.Duration
+	tiers       Tiers
+	mode        Mode
+	metricModes MetricModes
+	modes       []Mode
+	users       bool
+	quit        chan struct{}
+}
+
+// Options for DistinctName
+type Options struct {
+	// Location is the reporting timezone, UTC if nil
+	Location *time.Location
+
+	// Grace is the time after a period ends before rolling it up, late
+	// events are still counted in finer sets until then
+	Grace time.Duration
+
+	// Tiers enabled, DefaultTiers if empty
+	Tiers Tiers
+
+	// Mode metrics are counted in, Count by default
+	Mode Mode
+
+	// MetricModes overrides Mode for some metrics
+	MetricModes MetricModes
+
+	// Users estimates the unique users of each metric in every period
+	Users bool
+}
+
+func (o Options) withDefaults() Options {
+	if o.Location == nil {
+		o.Location = time.UTC
+	}
+	if len(o.Tiers) == 0 {
+		o.Tiers, _ = ParseTiers(DefaultTiers)
+	}
+	return o
+}
+
+// Modes returns the modes in use, sorted
+func (o Options) Modes() []Mode {
+	used := make([]bool, len(modeNames))
+	used[o.Mode] = true
+	for _, m := range o.MetricModes {
+		used[m] = true
+	}
+
+	var modes []Mode
+	for m, ok := range used {
+		if ok {
+			modes = append(modes, Mode(m))
+		}
+	}
+	return modes
 }
 
 // NewDistinctName intializes and returns a new distinct name processor
-func NewDistinctName(url string) (*DistinctName, error) {
-	log.Debug(fmt.Sprintf("Connecting to Redis (%s)", url))
+func NewDistinctName(url string, opts Options) (*DistinctName, error) {
+	log.Debugf("Connecting to Redis (%s)", url)
 	client := redis.NewClient(&redis.Options{
 		Addr:     url,
 		Password: "",
@@ -29,93 +89,123 @@ func NewDistinctName(url string) (*DistinctName, error) {
 
 	_, err := client.Ping().Result()
 	if err != nil {
-		log.Error("Error connecting to Redis")
+		log.Errorf("Error connecting to Redis: %s", err)
 		return nil, err
 	}
 
-	return initDistinctName(client), nil
+	return initDistinctName(client, opts), nil
 }
 
-func initDistinctName(client *redis.Client) *DistinctName {
+func initDistinctName(client *redis.Client, opts Options) *DistinctName {
+	opts = opts.withDefaults()
 	var processor DistinctName
 	processor.client = client
+	processor.loc = opts.Location
+	processor.grace = opts.Grace
+	processor.tiers = opts.Tiers
+	processor.mode = opts.Mode
+	processor.metricModes = opts.MetricModes
+	processor.modes = opts.Modes()
+	processor.users = opts.Users
+	processor.quit = make(chan struct{})
 	go processor.runConsolidate()
 	return &processor
 }
 
 // Process data from the queue
 func (p DistinctName) Process(d queue.MetricData) error {
-	// Do a ZADD (INCR mode)
-	return p.insert(time.Now(), &d)
+	return p.insert(d.EventTime(), &d)
 }
 
-func (p DistinctName) insert(t time.Time, d *queue.MetricData) error {
-	set := dailySetName(t)
-	value := redis.Z{float64(1), d.Metric}
-	_, err := p.client.ZIncr(set, value).Result()
-	return err
-}
-
-// runConsolidate calls `monthlyConsolidate` in an infinite loop
-// this method runs the consolidate process every 10 mins (for demostration
-// purposes)
-// It would be enough to run it after changing month or on a monthly basis
-func (p DistinctName) runConsolidate() {
-	for range time.Tick(10 * time.Minute) {
-		p.monthlyConsolidate()
+// modeOf returns the mode the metric is counted in
+func (p DistinctName) modeOf(metric string) Mode {
+	if m, ok := p.metricModes[metric]; ok {
+		return m
 	}
+	return p.mode
 }
 
-// monthlyConsolidate acumulates all daily results in a monthly set
-func (p DistinctName) monthlyConsolidate() {
-	log.Info("Checking past month consolidation status...")
-	now := time.Now()
-	pastMonth := time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, time.UTC)
-	exists, err := p.client.Exists(monthlySetName(pastMonth)).Result()
-	if err != nil {
-		log.Error("Error checking if monthly set exists", err)
-	}
-	// Already acumulated, wait for the next month
-	if exists {
-		log.Info("Consolidation was already done, nothing to do")
-		return
+func (p DistinctName) insert(t time.Time, d *queue.MetricData) error {
+	t = t.In(p.loc)
+	if p.users {
+		// Users are counted first, retrying them on failure is harmless
+		if err := p.insertUser(t, d.Metric, d.Username); err != nil {
+			return err
+		}
 	}
 
-	// Acumulate all days in the month
-	nDays := daysIn(pastMonth.Month(), pastMonth.Year())
-	days := make([]string, nDays, nDays)
-	for i := 0; i < nDays; i++ {
-		days[i] = dailySetName(pastMonth.Add(time.Duration(i*24) * time.Hour))
+	mode := p.modeOf(d.Metric)
+	value := mode.value(d.Count)
+	finest := p.tiers[0]
+	set := finest.Tier.setName(mode, t)
+
+	args := []string{d.Metric, strconv.FormatInt(value, 10), mode.String()}
+	if len(p.tiers) > 1 {
+		// Late events may arrive after their period was rolled up
+		if t.Before(p.tiers[1].Tier.start(time.Now().In(p.loc))) {
+			keys := []string{set}
+			for _, c := range p.tiers[1:] {
+				coarse := c.Tier.setName(mode, t)
+				keys = append(keys, coarse, statusName(coarse))
+			}
+			return lateScript.Run(p.client, keys, args).Err()
+		}
 	}
 
-	set := monthlySetName(pastMonth)
-	log.Info(fmt.Sprintf("Consolidating past month into %s", set))
-	log.Debug(fmt.Sprintf("Daily sets: %#v", days))
-	if _, err = p.client.ZUnionStore(
-		set,
-		redis.ZStore{Aggregate: "SUM"},
-		days...,
-	).Result(); err != nil {
-		log.Error("Error creating monthly set", err)
+	var err error
+	if mode == Count || mode == Sum {
+		// Do a ZADD (INCR mode)
+		err = p.client.ZIncr(set, redis.Z{Score: float64(value), Member: d.Metric}).Err()
+	} else {
+		err = updateScript.Run(p.client, []string{set}, args).Err()
+	}
+	if err != nil {
+		return err
 	}
 
-	log.Info("Consolidation done, cleaning up")
-	if _, err = p.client.Del(days...).Result(); err != nil {
-		log.Warning("Could not cleanup daily data after consolidation", err)
+	// A single tier is never rolled up, expire it right away
+	if at := finest.expireAt(finest.Tier.start(t)); len(p.tiers) == 1 && !at.IsZero() {
+		return p.client.ExpireAt(set, at).Err()
 	}
+	return nil
+}
+
+// Check the Redis connection
+func (p DistinctName) Check() error {
+	return p.client.Ping().Err()
 }
 
-// dailySetName returns daily set name for a given date
-func dailySetName(t time.Time) string {
-	return fmt.Sprintf("metrics:dn:%d:%d", t.Month(), t.Day())
+// Concurrency hint, metrics are counted one at a time and in arrival order
+func (p DistinctName) Concurrency() int {
+	return 1
 }
 
-// monthlySetName
-func monthlySetName(t time.Time) string {
-	return fmt.Sprintf("metrics:dn:%d", t.Month())
+// Close stops the consolidation loop and the Redis client
+func (p DistinctName) Close() error {
+	close(p.quit)
+	return p.client.Close()
 }
 
-// daysIn return the number of days in a given month
-func daysIn(m time.Month, year int) int {
-	return time.Date(year, m+1, 0, 0, 0, 0, 0, time.UTC).Day()
+// runConsolidate rolls up tiers as their periods end, until closed. It runs
+// once on start, to catch up with periods ended while stopped
+func (p DistinctName) runConsolidate() {
+	if len(p.tiers) < 2 {
+		return
+	}
+	for {
+		now := time.Now()
+		next := p.tiers.nextRollup(now, p.grace)
+		if !p.rollup(now) && now.Add(retryInterval).Before(next) {
+			next = now.Add(retryInterval)
+		}
+
+		log.Debugf("Next rollup at %s", next)
+		timer := time.NewTimer(next.Sub(time.Now()))
+		select {
+		case <-timer.C:
+		case <-p.quit:
+			timer.Stop()
+			return
+		}
+	}
 }
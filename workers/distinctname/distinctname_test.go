@@ -1,7 +1,7 @@
 package distinctname
 
 import (
-	"fmt"
+	"reflect"
 	"testing"
 	"time"
 
@@ -22,25 +22,24 @@ func TestDistinctName(t *testing.T) {
 		t.Skip("redis server not available")
 	}
 
-	processor, err := NewDistinctName("localhost:6379")
+	processor, err := NewDistinctName("localhost:6379", Options{})
 	if err != nil {
 		t.Error(err)
 	}
 
-	if err = processor.Process(queue.MetricData{"user1", 5, "metric1"}); err != nil {
+	if err = processor.Process(queue.MetricData{Username: "user1", Count: 5, Metric: "metric1"}); err != nil {
 		t.Error("Processing a metric", err)
 	}
 
-	if err = processor.Process(queue.MetricData{"user1", 1, "metric1"}); err != nil {
+	if err = processor.Process(queue.MetricData{Username: "user1", Count: 1, Metric: "metric1"}); err != nil {
 		t.Error("Processing a metric", err)
 	}
 
-	if err = processor.Process(queue.MetricData{"user1", 7, "metric2"}); err != nil {
+	if err = processor.Process(queue.MetricData{Username: "user1", Count: 7, Metric: "metric2"}); err != nil {
 		t.Error("Processing a metric", err)
 	}
 
-	now := time.Now()
-	set := fmt.Sprintf("metrics:dn:%d:%d", now.Month(), now.Day())
+	set := Day.setName(Count, time.Now().UTC())
 	res, err := client.ZRangeWithScores(set, 0, -1).Result()
 	if err != nil {
 		t.Error("Could not get result from redis", err)
@@ -83,7 +82,7 @@ func TestDistinctNameConsolidation(t *testing.T) {
 		t.Skip("redis server not available")
 	}
 
-	processor, err := NewDistinctName("localhost:6379")
+	processor, err := NewDistinctName("localhost:6379", Options{})
 	if err != nil {
 		t.Error(err)
 	}
@@ -91,23 +90,23 @@ func TestDistinctNameConsolidation(t *testing.T) {
 	// Insert values from past month
 	now := time.Now()
 	date := time.Date(now.Year(), now.Month()-1, 5, 0, 0, 0, 0, time.UTC)
-	if err = processor.insert(date, &queue.MetricData{"user1", 5, "metric1"}); err != nil {
+	if err = processor.insert(date, &queue.MetricData{Username: "user1", Count: 5, Metric: "metric1"}); err != nil {
 		t.Error("Processing a metric", err)
 	}
 
 	// one day later...
 	date = date.Add(24 * time.Hour)
-	if err = processor.insert(date, &queue.MetricData{"user1", 1, "metric1"}); err != nil {
+	if err = processor.insert(date, &queue.MetricData{Username: "user1", Count: 1, Metric: "metric1"}); err != nil {
 		t.Error("Processing a metric", err)
 	}
 
 	date = date.Add(24 * time.Hour)
-	if err = processor.insert(date, &queue.MetricData{"user1", 7, "metric2"}); err != nil {
+	if err = processor.insert(date, &queue.MetricData{Username: "user1", Count: 7, Metric: "metric2"}); err != nil {
 		t.Error("Processing a metric", err)
 	}
 
-	processor.monthlyConsolidate()
-	set := fmt.Sprintf("metrics:dn:%d:%d", now.Month(), now.Day())
+	processor.rollup(now)
+	set := Day.setName(Count, now.UTC())
 	res, err := client.ZRangeWithScores(set, 0, -1).Result()
 	if err != nil {
 		t.Error("Could not get result from redis", err)
@@ -167,3 +166,397 @@ func TestDaysIn(t *testing.T) {
 		}
 	}
 }
+
+func TestMigratedKey(t *testing.T) {
+	now := time.Date(2016, 5, 4, 10, 0, 0, 0, time.UTC)
+	var tests = []struct {
+		key, res string
+		ok       bool
+	}{
+		{"metrics:dn:5:4", "metrics:dn:2016-05-04", true},
+		{"metrics:dn:5:5", "metrics:dn:2015-05-05", true},
+		{"metrics:dn:1:31", "metrics:dn:2016-01-31", true},
+		{"metrics:dn:12:1", "metrics:dn:2015-12-01", true},
+		{"metrics:dn:4", "metrics:dn:2016-04", true},
+		// The current month was not consolidated yet, it's last year's
+		{"metrics:dn:5", "metrics:dn:2015-05", true},
+		{"metrics:dn:6", "metrics:dn:2015-06", true},
+		// Feb 2016 had 29 days
+		{"metrics:dn:2:29", "metrics:dn:2016-02-29", true},
+		{"metrics:dn:2:30", "", false},
+		{"metrics:dn:13", "", false},
+		{"metrics:dn:2016-05-04", "", false},
+	}
+
+	for _, v := range tests {
+		if res, ok := migratedKey(v.key, now); res != v.res || ok != v.ok {
+			t.Errorf("Incorrect migration of %s: %s, %v (%s, %v expected)", v.key, res, ok, v.res, v.ok)
+		}
+	}
+}
+
+func TestConsolidateOnce(t *testing.T) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     "localhost:6379",
+		Password: "",
+		DB:       0,
+	})
+
+	_, err := client.Ping().Result()
+	if err != nil {
+		t.Skip("redis server not available")
+	}
+
+	// An old month, so tests don't interfere
+	month := time.Date(2001, 3, 1, 0, 0, 0, 0, time.UTC)
+	client.Del(Month.setName(Count, month), statusName(Month.setName(Count, month)), lockKey)
+	defer client.Del(Month.setName(Count, month), statusName(Month.setName(Count, month)))
+
+	processor := initDistinctName(client, Options{})
+	defer close(processor.quit)
+	for i := 0; i < 3; i++ {
+		processor.insert(month.AddDate(0, 0, i), &queue.MetricData{Username: "user1", Count: 1, Metric: "metric1"})
+	}
+
+	// Replicas racing to consolidate, only one does it
+	done := make(chan bool)
+	for i := 0; i < 5; i++ {
+		go func() {
+			ok, err := processor.consolidate(Month, Count, month)
+			if err != nil && err != ErrLocked {
+				t.Error(err)
+			}
+			done <- ok
+		}()
+	}
+	consolidated := 0
+	for i := 0; i < 5; i++ {
+		if <-done {
+			consolidated++
+		}
+	}
+	if consolidated != 1 {
+		t.Errorf("Expected a single consolidation, got %d", consolidated)
+	}
+
+	if score := client.ZScore(Month.setName(Count, month), "metric1").Val(); score != 3 {
+		t.Errorf("Expected 3 occurrences of 'metric1', got %g", score)
+	}
+	if client.Exists(Day.setName(Count, month)).Val() {
+		t.Error("Daily sets should be deleted after consolidation")
+	}
+
+	// Late events go to the monthly set
+	processor.insert(month, &queue.MetricData{Username: "user1", Count: 1, Metric: "metric1"})
+	if score := client.ZScore(Month.setName(Count, month), "metric1").Val(); score != 4 {
+		t.Errorf("Expected the late event in the monthly set, got %g", score)
+	}
+}
+
+func TestConsolidateForce(t *testing.T) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     "localhost:6379",
+		Password: "",
+		DB:       0,
+	})
+
+	_, err := client.Ping().Result()
+	if err != nil {
+		t.Skip("redis server not available")
+	}
+
+	month := time.Date(2001, 4, 1, 0, 0, 0, 0, time.UTC)
+	tiers, _ := ParseTiers(DefaultTiers)
+	keys := newConsolidation(tiers, 1, Count, month).keys
+	client.Del(keys...)
+	defer client.Del(keys...)
+
+	// A partial consolidation left a wrong monthly set and the daily ones
+	client.ZIncrBy(Month.setName(Count, month), 10, "stale")
+	client.HMSet(statusName(Month.setName(Count, month)), "instance", "test")
+	client.ZIncrBy(Day.setName(Count, month), 2, "metric1")
+	client.ZIncrBy(Day.setName(Count, month.AddDate(0, 0, 1)), 1, "metric2")
+
+	report, err := consolidate(client, time.UTC, tiers, Month, Count, month, ConsolidateOptions{})
+	if err != nil || report.Consolidated {
+		t.Fatalf("Expected nothing done without force, got %+v, %v", report, err)
+	}
+
+	report, err = consolidate(client, time.UTC, tiers, Month, Count, month, ConsolidateOptions{Force: true, DryRun: true})
+	if err != nil || !report.Consolidated || report.Before != 1 || report.After != 2 || report.Merged != 2 {
+		t.Fatalf("Unexpected dry run report %+v, %v", report, err)
+	}
+	if client.ZScore(Month.setName(Count, month), "stale").Val() != 10 {
+		t.Error("Dry run changed the monthly set")
+	}
+
+	report, err = consolidate(client, time.UTC, tiers, Month, Count, month, ConsolidateOptions{Force: true, KeepFiner: true})
+	if err != nil || report.Before != 1 || report.After != 2 || report.Merged != 2 {
+		t.Fatalf("Unexpected report %+v, %v", report, err)
+	}
+	if client.ZScore(Month.setName(Count, month), "metric1").Val() != 2 || client.ZScore(Month.setName(Count, month), "stale").Val() != 0 {
+		t.Error("Monthly set not rebuilt from the daily ones")
+	}
+	if !client.Exists(Day.setName(Count, month)).Val() {
+		t.Error("Daily sets should be kept")
+	}
+}
+
+func TestConsolidateForceLateEvents(t *testing.T) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     "localhost:6379",
+		Password: "",
+		DB:       0,
+	})
+
+	_, err := client.Ping().Result()
+	if err != nil {
+		t.Skip("redis server not available")
+	}
+
+	month := time.Date(2001, 5, 1, 0, 0, 0, 0, time.UTC)
+	tiers, _ := ParseTiers(DefaultTiers)
+	keys := newConsolidation(tiers, 1, Count, month).keys
+	client.Del(keys...)
+	defer client.Del(keys...)
+
+	processor := initDistinctName(client, Options{})
+	defer close(processor.quit)
+	processor.insert(month, &queue.MetricData{Username: "user1", Count: 1, Metric: "metric1"})
+
+	_, err = consolidate(client, time.UTC, tiers, Month, Count, month, ConsolidateOptions{KeepFiner: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A late event goes to the monthly set and the kept daily one
+	processor.insert(month, &queue.MetricData{Username: "user1", Count: 1, Metric: "metric1"})
+	if score := client.ZScore(Day.setName(Count, month), "metric1").Val(); score != 2 {
+		t.Errorf("Expected the late event in the kept daily set, got %g", score)
+	}
+
+	_, err = consolidate(client, time.UTC, tiers, Month, Count, month, ConsolidateOptions{Force: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if score := client.ZScore(Month.setName(Count, month), "metric1").Val(); score != 2 {
+		t.Errorf("Expected the late event in the rebuilt monthly set, got %g", score)
+	}
+}
+
+func TestParseTiers(t *testing.T) {
+	tiers, err := ParseTiers("hour:48h, day:90d,month,year:3650d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Tiers{
+		{Hour, 48 * time.Hour},
+		{Day, 90 * 24 * time.Hour},
+		{Month, Forever},
+		{Year, 3650 * 24 * time.Hour},
+	}
+	if !reflect.DeepEqual(tiers, expected) {
+		t.Errorf("Expected %s, got %s", expected, tiers)
+	}
+
+	for _, s := range []string{"", "week", "month,day", "day,day", "day:-1h", "day:xd", "day:0"} {
+		if _, err := ParseTiers(s); err == nil {
+			t.Errorf("Expected an error parsing '%s'", s)
+		}
+	}
+}
+
+func TestNewConsolidation(t *testing.T) {
+	madrid, err := time.LoadLocation("Europe/Madrid")
+	if err != nil {
+		t.Skip("no timezone data")
+	}
+	tiers, _ := ParseTiers("hour:48h,day:90d,month")
+
+	// DST starts on 2016-03-27, the day has 23 hours
+	day := time.Date(2016, 3, 27, 0, 0, 0, 0, madrid)
+	c := newConsolidation(tiers, 1, Count, day)
+	if c.keys[0] != "metrics:dn:2016-03-27" || len(c.keys) != 2+23 {
+		t.Fatalf("Unexpected keys %v", c.keys)
+	}
+	if c.keys[2] != "metrics:dn:2016-03-27T00+0100" || c.keys[len(c.keys)-1] != "metrics:dn:2016-03-27T23+0200" {
+		t.Errorf("Unexpected hours %v", c.keys[2:])
+	}
+	// Hours expire 48h after they end (01:00 CET), days are not the coarsest tier
+	if !c.expires[0].IsZero() || !c.expires[1].Equal(time.Date(2016, 3, 29, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected expirations %v", c.expires)
+	}
+
+	// DST ends on 2016-10-30, the day has 25 hours and 02:00 happens twice
+	c = newConsolidation(tiers, 1, Count, time.Date(2016, 10, 30, 0, 0, 0, 0, madrid))
+	if len(c.keys) != 2+25 || c.keys[4] != "metrics:dn:2016-10-30T02+0200" || c.keys[5] != "metrics:dn:2016-10-30T02+0100" {
+		t.Fatalf("Unexpected keys %v", c.keys)
+	}
+	unique := make(map[string]bool)
+	for _, key := range c.keys {
+		unique[key] = true
+	}
+	if len(unique) != len(c.keys) {
+		t.Errorf("Repeated keys %v", c.keys)
+	}
+
+	month := newConsolidation(tiers, 2, Count, time.Date(2016, 2, 1, 0, 0, 0, 0, madrid))
+	if len(month.keys) != 2+29 || !month.expires[0].IsZero() {
+		t.Errorf("Unexpected month consolidation %v %v", month.keys, month.expires)
+	}
+}
+
+func TestRolledUpPeriod(t *testing.T) {
+	tiers, _ := ParseTiers(DefaultTiers)
+	now := time.Date(2016, 6, 1, 0, 30, 0, 0, time.UTC)
+
+	i, start, err := rolledUpPeriod(time.UTC, tiers, Month, time.Date(2016, 4, 10, 0, 0, 0, 0, time.UTC), now, time.Hour)
+	if err != nil || i != 1 || !start.Equal(time.Date(2016, 4, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected period %d %s %v", i, start, err)
+	}
+
+	// The current month, the last one within its grace period and a future one
+	for _, month := range []time.Month{6, 5, 7} {
+		if _, _, err := rolledUpPeriod(time.UTC, tiers, Month, time.Date(2016, month, 1, 0, 0, 0, 0, time.UTC), now, time.Hour); err != ErrNotEnded {
+			t.Errorf("Expected month %d to be refused, got %v", month, err)
+		}
+	}
+	if _, _, err := rolledUpPeriod(time.UTC, tiers, Month, time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC), now, 0); err != nil {
+		t.Errorf("Expected the last month to be consolidated without grace, got %v", err)
+	}
+
+	if _, _, err := rolledUpPeriod(time.UTC, tiers, Day, now, now, 0); err == nil {
+		t.Error("Expected an error for a tier which is not rolled up")
+	}
+}
+
+func TestNextRollup(t *testing.T) {
+	tiers, _ := ParseTiers("hour:48h,day:90d,month,year")
+	now := time.Date(2016, 5, 4, 10, 30, 0, 0, time.UTC)
+	if next := tiers.nextRollup(now, time.Hour); !next.Equal(time.Date(2016, 5, 5, 1, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected next rollup after the day ends, got %s", next)
+	}
+
+	// Within the grace period of the day
+	now = time.Date(2016, 5, 4, 0, 30, 0, 0, time.UTC)
+	if next := tiers.nextRollup(now, time.Hour); !next.Equal(time.Date(2016, 5, 4, 1, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected next rollup after the grace period, got %s", next)
+	}
+}
+
+func TestParseModes(t *testing.T) {
+	mode, modes, err := ParseModes("sum, kite_call:count,latency:max")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode != Sum || !reflect.DeepEqual(modes, MetricModes{"kite_call": Count, "latency": Max}) {
+		t.Errorf("Unexpected modes %s %v", mode, modes)
+	}
+	opts := Options{Mode: mode, MetricModes: modes}
+	if !reflect.DeepEqual(opts.Modes(), []Mode{Count, Sum, Max}) {
+		t.Errorf("Unexpected modes in use %v", opts.Modes())
+	}
+
+	for _, s := range []string{"", "avg", "sum,max", ":sum", "latency:"} {
+		if _, _, err := ParseModes(s); err == nil {
+			t.Errorf("Expected an error parsing '%s'", s)
+		}
+	}
+
+	if Day.setName(Sum, time.Date(2016, 5, 4, 0, 0, 0, 0, time.UTC)) != "metrics:dn:sum:2016-05-04" {
+		t.Error("Expected sums in sets of their own")
+	}
+}
+
+func TestDistinctNameModes(t *testing.T) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     "localhost:6379",
+		Password: "",
+		DB:       0,
+	})
+
+	if err := client.Ping().Err(); err != nil {
+		t.Skip("redis server not available")
+	}
+
+	processor := initDistinctName(client, Options{Mode: Sum, MetricModes: MetricModes{"latency": Max}})
+	defer close(processor.quit)
+
+	now := time.Now()
+	sums, maxes := Day.setName(Sum, now.UTC()), Day.setName(Max, now.UTC())
+	client.Del(sums, maxes)
+	defer client.Del(sums, maxes)
+
+	for _, d := range []queue.MetricData{
+		{Username: "user1", Count: 5, Metric: "metric1"},
+		{Username: "user1", Count: 2, Metric: "metric1"},
+		{Username: "user1", Count: 30, Metric: "latency"},
+		{Username: "user1", Count: 10, Metric: "latency"},
+	} {
+		if err := processor.insert(now, &d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if score := client.ZScore(sums, "metric1").Val(); score != 7 {
+		t.Errorf("Expected metric1 sum 7, got %v", score)
+	}
+	if score := client.ZScore(maxes, "latency").Val(); score != 30 {
+		t.Errorf("Expected latency max 30, got %v", score)
+	}
+}
+
+func TestDistinctNameUsers(t *testing.T) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     "localhost:6379",
+		Password: "",
+		DB:       0,
+	})
+
+	if err := client.Ping().Err(); err != nil {
+		t.Skip("redis server not available")
+	}
+
+	tiers, _ := ParseTiers(DefaultTiers)
+	processor := initDistinctName(client, Options{Tiers: tiers, Users: true})
+	defer close(processor.quit)
+
+	month := time.Date(2015, 2, 1, 0, 0, 0, 0, time.UTC)
+	index := usersName(Month, month)
+	client.Del(index, usersLogName(index, "metric1"), statusName(index), lockKey)
+	defer client.Del(index, usersLogName(index, "metric1"), statusName(index))
+
+	for i, username := range []string{"user1", "user2", "user1", "user3"} {
+		if err := processor.insertUser(month.AddDate(0, 0, i), "metric1", username); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := consolidateUsers(client, time.UTC, tiers, Month, month, ConsolidateOptions{})
+	if err != nil || !report.Consolidated || report.Merged != 4 || report.After != 1 {
+		t.Fatalf("Unexpected consolidation %+v: %v", report, err)
+	}
+	if users := client.PFCount(usersLogName(index, "metric1")).Val(); users != 3 {
+		t.Errorf("Expected 3 users of metric1, got %d", users)
+	}
+	if client.Exists(usersName(Day, month)).Val() {
+		t.Error("Daily users should be deleted once consolidated")
+	}
+
+	// Late events go to the month
+	processor.insertUser(month, "metric1", "user4")
+	if users := client.PFCount(usersLogName(index, "metric1")).Val(); users != 4 {
+		t.Errorf("Expected 4 users of metric1, got %d", users)
+	}
+}
+
+func TestUsersLogName(t *testing.T) {
+	index := usersName(Day, time.Date(2016, 5, 4, 0, 0, 0, 0, time.UTC))
+	if name := usersLogName(index, "kite_call"); name != "metrics:dn:users:hll:2016-05-04:kite_call" {
+		t.Errorf("Unexpected HyperLogLog name %s", name)
+	}
+	// A metric named status doesn't clash with the status of the index
+	if usersLogName(index, "status") == statusName(index) {
+		t.Error("HyperLogLog of 'status' clashes with the index status")
+	}
+}
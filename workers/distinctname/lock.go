@@ -0,0 +1,46 @@
+package distinctname
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"gopkg.in/redis.v3"
+)
+
+// releaseScript deletes the lock only if it's still held with our token, so
+// an expired lease taken by another instance is not released
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// lease is a lock in Redis held for at most ttl, so it's freed if its holder
+// dies. Work done under it must take less than ttl
+type lease struct {
+	client *redis.Client
+	key    string
+	token  string
+}
+
+// acquire the lock in key for ttl, returns nil if it's held by someone else
+func acquire(client *redis.Client, key string, ttl time.Duration) (*lease, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	l := &lease{client: client, key: key, token: hex.EncodeToString(token)}
+
+	ok, err := client.SetNX(key, l.token, ttl).Result()
+	if err != nil || !ok {
+		return nil, err
+	}
+	return l, nil
+}
+
+// release the lock if we still hold it
+func (l *lease) release() error {
+	return releaseScript.Run(l.client, []string{l.key}, []string{l.token}).Err()
+}
@@ -0,0 +1,113 @@
+package distinctname
+
+import (
+	"regexp"
+	"strconv"
+	"time"
+
+	"gopkg.in/redis.v3"
+)
+
+// legacyKey matches set names of the former scheme, without year:
+// `metrics:dn:<month>:<day>` and `metrics:dn:<month>`
+var legacyKey = regexp.MustCompile(`^metrics:dn:(\d{1,2})(?::(\d{1,2}))?$`)
+
+// Migrate rewrites the sets named without year into the current scheme, see
+// migratedKey. Counts are added to the new set if it already exists, so it
+// is safe to run while processing metrics. Returns the number of migrated sets
+func Migrate(url string, loc *time.Location) (int, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     url,
+		Password: "",
+		DB:       0,
+	})
+	defer client.Close()
+
+	if err := client.Ping().Err(); err != nil {
+		log.Errorf("Error connecting to Redis: %s", err)
+		return 0, err
+	}
+	return migrate(client, time.Now().In(loc))
+}
+
+func migrate(client *redis.Client, now time.Time) (int, error) {
+	var keys []string
+	var cursor int64
+	for {
+		next, page, err := client.Scan(cursor, "metrics:dn:*", 100).Result()
+		if err != nil {
+			return 0, err
+		}
+		keys = append(keys, page...)
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+
+	migrated := 0
+	for _, key := range keys {
+		if !legacyKey.MatchString(key) {
+			continue
+		}
+		newKey, ok := migratedKey(key, now)
+		if !ok {
+			log.Warningf("Skipping '%s', not a valid date", key)
+			continue
+		}
+
+		// Merge and delete atomically, so running it twice won't double
+		// count
+		multi := client.Multi()
+		_, err := multi.Exec(func() error {
+			multi.ZUnionStore(newKey, redis.ZStore{Aggregate: "SUM"}, newKey, key)
+			multi.Del(key)
+			// Monthly sets were consolidated by former versions
+			if monthly := legacyKey.FindStringSubmatch(key)[2] == ""; monthly {
+				multi.HMSet(statusName(newKey), "consolidated_at", now.UTC().Format(time.RFC3339), "instance", "migration")
+			}
+			return nil
+		})
+		multi.Close()
+		if err != nil {
+			return migrated, err
+		}
+		log.Infof("Migrated '%s' to '%s'", key, newKey)
+		migrated++
+	}
+	return migrated, nil
+}
+
+// migratedKey returns the current name of a set named without year. Its year
+// is the latest one in which the date is not after now, but for monthly sets
+// which were only written once their month was over: the latest one in which
+// the month ended before now
+func migratedKey(key string, now time.Time) (string, bool) {
+	match := legacyKey.FindStringSubmatch(key)
+	if match == nil {
+		return "", false
+	}
+	month, _ := strconv.Atoi(match[1])
+	if month < 1 || month > 12 {
+		return "", false
+	}
+
+	if match[2] == "" {
+		year := now.Year()
+		if time.Month(month) >= now.Month() {
+			year--
+		}
+		return Month.setName(Count, time.Date(year, time.Month(month), 1, 0, 0, 0, 0, now.Location())), true
+	}
+
+	day, _ := strconv.Atoi(match[2])
+	year := now.Year()
+	t := time.Date(year, time.Month(month), day, 0, 0, 0, 0, now.Location())
+	if t.After(now) {
+		year--
+		t = time.Date(year, time.Month(month), day, 0, 0, 0, 0, now.Location())
+	}
+	if day < 1 || day > daysIn(time.Month(month), year) {
+		return "", false
+	}
+	return Day.setName(Count, t), true
+}
@@ -0,0 +1,93 @@
+package distinctname
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Mode of counting a metric in its sets. Each mode writes to its own sets,
+// ie. `metrics:dn:sum:2016-05-04`, except Count that keeps the plain names
+type Mode int
+
+// Modes
+const (
+	// Count occurrences of the metric
+	Count Mode = iota
+	// Sum the count of its events
+	Sum
+	// Max keeps the highest count of its events
+	Max
+	// Min keeps the lowest count of its events
+	Min
+)
+
+var modeNames = [...]string{"count", "sum", "max", "min"}
+
+// aggregate of ZUNIONSTORE rolling up the sets of each mode
+var modeAggregates = [...]string{"SUM", "SUM", "MAX", "MIN"}
+
+func (m Mode) String() string {
+	return modeNames[m]
+}
+
+// ParseMode returns the mode with the given name
+func ParseMode(name string) (Mode, error) {
+	for i, n := range modeNames {
+		if n == name {
+			return Mode(i), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown mode '%s', expected count, sum, max or min", name)
+}
+
+// prefix of the set names of the mode
+func (m Mode) prefix() string {
+	if m == Count {
+		return "metrics:dn:"
+	}
+	return "metrics:dn:" + m.String() + ":"
+}
+
+// value an event adds to the sets of the mode
+func (m Mode) value(count int64) int64 {
+	if m == Count {
+		return 1
+	}
+	return count
+}
+
+// MetricModes overrides the mode of some metrics, by name
+type MetricModes map[string]Mode
+
+// DefaultModes counts occurrences of every metric
+const DefaultModes = "count"
+
+// ParseModes parses a comma separated list of modes, ie.
+// `count,kite_call:sum,latency:max`. Entries of the form metric:mode set the
+// mode of a metric, the one without metric the mode of the rest (Count if
+// none)
+func ParseModes(s string) (Mode, MetricModes, error) {
+	mode, modes, defaults := Count, make(MetricModes), 0
+	for _, spec := range strings.Split(s, ",") {
+		spec = strings.TrimSpace(spec)
+		i := strings.LastIndex(spec, ":")
+		m, err := ParseMode(spec[i+1:])
+		if err != nil {
+			return mode, nil, err
+		}
+
+		switch {
+		case i < 0:
+			mode = m
+			defaults++
+		case i == 0:
+			return mode, nil, fmt.Errorf("Invalid mode '%s', expected mode or metric:mode", spec)
+		default:
+			modes[spec[:i]] = m
+		}
+	}
+	if defaults > 1 {
+		return mode, nil, fmt.Errorf("Expected at most one mode without metric in '%s'", s)
+	}
+	return mode, modes, nil
+}
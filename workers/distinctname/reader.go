@@ -0,0 +1,288 @@
+package distinctname
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"gopkg.in/redis.v3"
+
+	"github.com/exekias/metric-collector/api"
+)
+
+// Reader queries the counts stored by DistinctName, implements api.TopReader
+// and api.UsersReader
+type Reader struct {
+	client *redis.Client
+	loc    *time.Location
+	tiers  Tiers
+	modes  []Mode
+	users  bool
+}
+
+// NewReader connects to the Redis server DistinctName writes to, with the
+// same options
+func NewReader(url string, opts Options) (*Reader, error) {
+	log.Debugf("Connecting to Redis (%s)", url)
+	client := redis.NewClient(&redis.Options{
+		Addr:     url,
+		Password: "",
+		DB:       0,
+	})
+
+	if err := client.Ping().Err(); err != nil {
+		log.Errorf("Error connecting to Redis: %s", err)
+		return nil, err
+	}
+	opts = opts.withDefaults()
+	return &Reader{client: client, loc: opts.Location, tiers: opts.Tiers, modes: opts.Modes(), users: opts.Users}, nil
+}
+
+// Location returns the reporting timezone, periods start in it
+func (r *Reader) Location() *time.Location {
+	return r.loc
+}
+
+// periodTiers maps API periods to tiers
+var periodTiers = map[api.Period]Tier{
+	api.Hour:  Hour,
+	api.Day:   Day,
+	api.Month: Month,
+	api.Year:  Year,
+}
+
+// apiModes maps API modes to modes
+var apiModes = map[api.Mode]Mode{
+	api.Count: Count,
+	api.Sum:   Sum,
+	api.Max:   Max,
+	api.Min:   Min,
+}
+
+// Top returns the n metrics with the highest count in the mode and period
+// queried, in the reporting timezone. Periods not rolled up yet, or of a tier
+// not enabled, are aggregated from the finer sets
+func (r *Reader) Top(q api.TopQuery) ([]api.MetricCount, error) {
+	tier := periodTiers[q.Period]
+	if tier < r.tiers[0].Tier {
+		return nil, api.ErrUnsupported(fmt.Sprintf("Counts are kept per %s at most", r.tiers[0].Tier))
+	}
+	mode := apiModes[q.Mode]
+	if !r.counted(mode) {
+		return nil, api.ErrUnsupported(fmt.Sprintf("No metrics are counted in %s mode", mode))
+	}
+
+	start := tier.start(q.Time.In(r.loc))
+	set := tier.setName(mode, start)
+	if ok, err := r.stored(tier, set); err != nil {
+		return nil, err
+	} else if ok {
+		return r.top(set, q.N)
+	}
+
+	counts := make(map[string]int64)
+	if err := r.counts(tier, mode, start, counts); err != nil {
+		return nil, err
+	}
+
+	res := make([]api.MetricCount, 0, len(counts))
+	for metric, count := range counts {
+		res = append(res, api.MetricCount{Metric: metric, Count: count})
+	}
+	sort.Sort(byCount(res))
+	if len(res) > q.N {
+		res = res[:q.N]
+	}
+	return res, nil
+}
+
+// counted returns whether any metric is counted in mode
+func (r *Reader) counted(mode Mode) bool {
+	for _, m := range r.modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// stored returns whether key (a set or users index) holds the whole period
+// of tier, false if it has to be aggregated from finer ones
+func (r *Reader) stored(tier Tier, key string) (bool, error) {
+	i := r.tiers.index(tier)
+	if i < 0 {
+		return false, nil
+	}
+	if i == 0 {
+		return true, nil
+	}
+	return r.client.Exists(statusName(key)).Result()
+}
+
+// counts aggregates the counts of mode in the period of tier starting at
+// start into res
+func (r *Reader) counts(tier Tier, mode Mode, start time.Time, res map[string]int64) error {
+	set := tier.setName(mode, start)
+	ok, err := r.stored(tier, set)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return r.add(set, mode, res)
+	}
+
+	// Aggregate the finer enabled tier
+	finer := r.finer(tier)
+	for t := start; t.Before(tier.next(start)); t = finer.next(t) {
+		if err := r.counts(finer, mode, t, res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finer returns the closest enabled tier finer than tier
+func (r *Reader) finer(tier Tier) Tier {
+	finer := r.tiers[0].Tier
+	for _, c := range r.tiers {
+		if c.Tier < tier {
+			finer = c.Tier
+		}
+	}
+	return finer
+}
+
+// add the members of set to res, aggregated as mode does
+func (r *Reader) add(set string, mode Mode, res map[string]int64) error {
+	zs, err := r.client.ZRangeWithScores(set, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	for _, z := range zs {
+		metric, count := member(z), int64(z.Score)
+		if current, ok := res[metric]; ok {
+			switch {
+			case mode == Max && current > count, mode == Min && current < count:
+				count = current
+			case mode == Count, mode == Sum:
+				count += current
+			}
+		}
+		res[metric] = count
+	}
+	return nil
+}
+
+// top returns the n members of the set with the highest score
+func (r *Reader) top(set string, n int) ([]api.MetricCount, error) {
+	zs, err := r.client.ZRevRangeWithScores(set, 0, int64(n-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]api.MetricCount, len(zs))
+	for i, z := range zs {
+		res[i] = api.MetricCount{Metric: member(z), Count: int64(z.Score)}
+	}
+	return res, nil
+}
+
+// Users returns the estimated unique users of the metrics queried, all of
+// them if none, in the period queried in the reporting timezone. Periods not
+// rolled up yet, or of a tier not enabled, are merged from the finer ones
+func (r *Reader) Users(q api.UsersQuery) ([]api.UserCount, error) {
+	if !r.users {
+		return nil, api.ErrUnsupported("Unique users are not counted, see DISTINCT_USERS")
+	}
+	tier := periodTiers[q.Period]
+	if tier < r.tiers[0].Tier {
+		return nil, api.ErrUnsupported(fmt.Sprintf("Unique users are kept per %s at most", r.tiers[0].Tier))
+	}
+
+	var indexes []string
+	if err := r.usersIndexes(tier, tier.start(q.Time.In(r.loc)), &indexes); err != nil {
+		return nil, err
+	}
+
+	metrics := q.Metrics
+	if len(metrics) == 0 {
+		var err error
+		if metrics, err = r.client.SUnion(indexes...).Result(); err != nil {
+			return nil, err
+		}
+	}
+
+	res := make([]api.UserCount, 0, len(metrics))
+	for _, metric := range metrics {
+		logs := make([]string, len(indexes))
+		for i, index := range indexes {
+			logs[i] = usersLogName(index, metric)
+		}
+		// The count of several HyperLogLogs is that of their union
+		users, err := r.client.PFCount(logs...).Result()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, api.UserCount{Metric: metric, Users: users})
+	}
+	sort.Sort(byUsers(res))
+	if len(res) > q.Limit {
+		res = res[:q.Limit]
+	}
+	return res, nil
+}
+
+// usersIndexes adds to res the indexes of unique users covering the period
+// of tier starting at start, the finer ones if it's not rolled up
+func (r *Reader) usersIndexes(tier Tier, start time.Time, res *[]string) error {
+	index := usersName(tier, start)
+	ok, err := r.stored(tier, index)
+	if err != nil {
+		return err
+	}
+	if ok {
+		*res = append(*res, index)
+		return nil
+	}
+
+	finer := r.finer(tier)
+	for t := start; t.Before(tier.next(start)); t = finer.next(t) {
+		if err := r.usersIndexes(finer, t, res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// member name, redis returns them as strings
+func member(z redis.Z) string {
+	return fmt.Sprint(z.Member)
+}
+
+// byCount sorts metrics by count (descending), then name
+type byCount []api.MetricCount
+
+func (s byCount) Len() int      { return len(s) }
+func (s byCount) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byCount) Less(i, j int) bool {
+	if s[i].Count != s[j].Count {
+		return s[i].Count > s[j].Count
+	}
+	return s[i].Metric < s[j].Metric
+}
+
+// byUsers sorts metrics by unique users (descending), then name
+type byUsers []api.UserCount
+
+func (s byUsers) Len() int      { return len(s) }
+func (s byUsers) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byUsers) Less(i, j int) bool {
+	if s[i].Users != s[j].Users {
+		return s[i].Users > s[j].Users
+	}
+	return s[i].Metric < s[j].Metric
+}
+
+// Close the Redis client
+func (r *Reader) Close() error {
+	return r.client.Close()
+}
@@ -0,0 +1,51 @@
+package distinctname
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/exekias/metric-collector/constants"
+	"github.com/exekias/metric-collector/workers"
+)
+
+func init() {
+	workers.Register("distinctname", workers.Factory{
+		Description: "counts occurrences (or sums, max or min of counts) of each metric per hour, day, month or year in Redis",
+		Queue:       constants.Queues["distinctname"],
+		Settings: []workers.Setting{
+			{Name: "REDIS_URL", Default: "localhost:6379", Description: "Redis server"},
+			{Name: "REPORT_TIMEZONE", Default: "UTC", Description: "Timezone periods are counted in (ie. Europe/Madrid)"},
+			{Name: "CONSOLIDATION_GRACE", Default: DefaultGrace.String(), Description: "Time late events are accepted for a period before rolling it up"},
+			{Name: "DISTINCT_TIERS", Default: DefaultTiers, Description: "Tiers counted, finest to coarsest, with their retention (ie. hour:48h,day:90d,month,year)"},
+			{Name: "DISTINCT_MODES", Default: DefaultModes, Description: "How metrics are counted, occurrences (count) or sum, max or min of their count, by metric (ie. count,kite_call:sum,latency:max)"},
+			{Name: "DISTINCT_USERS", Default: "false", Description: "Estimate the unique users of each metric per period (true or false)"},
+		},
+		New: func(c workers.Config) (workers.MetricDataProcessor, error) {
+			opts, err := ParseOptions(c)
+			if err != nil {
+				return nil, err
+			}
+			return NewDistinctName(c.Get("REDIS_URL"), opts)
+		},
+	})
+}
+
+// ParseOptions reads the processor options from its settings
+func ParseOptions(c workers.Config) (Options, error) {
+	var opts Options
+	var err error
+	if opts.Location, err = time.LoadLocation(c.Get("REPORT_TIMEZONE")); err != nil {
+		return opts, err
+	}
+	if opts.Grace, err = time.ParseDuration(c.Get("CONSOLIDATION_GRACE")); err != nil {
+		return opts, err
+	}
+	if opts.Tiers, err = ParseTiers(c.Get("DISTINCT_TIERS")); err != nil {
+		return opts, err
+	}
+	if opts.Mode, opts.MetricModes, err = ParseModes(c.Get("DISTINCT_MODES")); err != nil {
+		return opts, err
+	}
+	opts.Users, err = strconv.ParseBool(c.Get("DISTINCT_USERS"))
+	return opts, err
+}
@@ -0,0 +1,194 @@
+package distinctname
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tier of distinct counts. Events are counted in sets of the finest tier
+// enabled, which are rolled up into the coarser ones as their periods end
+type Tier int
+
+// Tiers, from finest to coarsest
+const (
+	Hour Tier = iota
+	Day
+	Month
+	Year
+)
+
+var tierNames = [...]string{"hour", "day", "month", "year"}
+
+// set name formats by tier, ie. `metrics:dn:2016-05-04T10Z` for an hour.
+// Hours carry the UTC offset, so the hour repeated when DST ends has sets of
+// its own (`2016-10-30T02+0200` and `2016-10-30T02+0100`)
+var tierFormats = [...]string{"2006-01-02T15Z0700", "2006-01-02", "2006-01", "2006"}
+
+func (t Tier) String() string {
+	return tierNames[t]
+}
+
+// ParseTier returns the tier with the given name
+func ParseTier(name string) (Tier, error) {
+	for i, n := range tierNames {
+		if n == name {
+			return Tier(i), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown tier '%s', expected hour, day, month or year", name)
+}
+
+// start of the period containing tm, in tm's location
+func (t Tier) start(tm time.Time) time.Time {
+	switch t {
+	case Hour:
+		return time.Date(tm.Year(), tm.Month(), tm.Day(), tm.Hour(), 0, 0, 0, tm.Location())
+	case Day:
+		return time.Date(tm.Year(), tm.Month(), tm.Day(), 0, 0, 0, 0, tm.Location())
+	case Month:
+		return time.Date(tm.Year(), tm.Month(), 1, 0, 0, 0, 0, tm.Location())
+	default:
+		return time.Date(tm.Year(), 1, 1, 0, 0, 0, 0, tm.Location())
+	}
+}
+
+// next returns the start of the period after the one starting at start
+func (t Tier) next(start time.Time) time.Time {
+	switch t {
+	case Hour:
+		return start.Add(time.Hour)
+	case Day:
+		return start.AddDate(0, 0, 1)
+	case Month:
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(1, 0, 0)
+	}
+}
+
+// setName returns the name of the set of mode m counting the period
+// containing tm
+func (t Tier) setName(m Mode, tm time.Time) string {
+	return m.prefix() + tm.Format(tierFormats[t])
+}
+
+// statusName returns the name of the hash recording the rollup of a set
+func statusName(set string) string {
+	return set + ":status"
+}
+
+// Forever keeps the sets of a tier with no expiration
+const Forever time.Duration = -1
+
+// TierConfig is an enabled tier and the time its sets are kept after their
+// period ends, Forever if they don't expire. Retention of rolled up tiers is
+// enforced once they are rolled up, 0 deletes them right away
+type TierConfig struct {
+	Tier      Tier
+	Retention time.Duration
+}
+
+// expireAt returns when the set of the period starting at start expires,
+// zero if never
+func (c TierConfig) expireAt(start time.Time) time.Time {
+	if c.Retention == Forever {
+		return time.Time{}
+	}
+	return c.Tier.next(start).Add(c.Retention)
+}
+
+// Tiers enabled, from finest to coarsest
+type Tiers []TierConfig
+
+// DefaultTiers counts days, deleted once they are rolled up into months,
+// which are kept forever
+const DefaultTiers = "day:0,month"
+
+// ParseTiers parses a comma separated list of tier[:retention], from finest
+// to coarsest, ie. `hour:48h,day:90d,month,year`. Retentions are Go
+// durations or a number of days (`90d`), tiers without one are kept forever
+func ParseTiers(s string) (Tiers, error) {
+	var tiers Tiers
+	for _, spec := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(spec), ":", 2)
+		tier, err := ParseTier(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		if len(tiers) > 0 && tier <= tiers[len(tiers)-1].Tier {
+			return nil, fmt.Errorf("Tier '%s' out of order, expected tiers from finest to coarsest", tier)
+		}
+
+		c := TierConfig{Tier: tier, Retention: Forever}
+		if len(parts) == 2 {
+			if c.Retention, err = parseRetention(parts[1]); err != nil {
+				return nil, fmt.Errorf("Invalid retention for tier '%s': %s", tier, err)
+			}
+		}
+		tiers = append(tiers, c)
+	}
+
+	if last := tiers[len(tiers)-1]; last.Retention == 0 {
+		return nil, fmt.Errorf("Tier '%s' is not rolled up, it needs a retention", last.Tier)
+	}
+	return tiers, nil
+}
+
+func parseRetention(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days < 0 {
+			return 0, fmt.Errorf("expected a number of days, got '%s'", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err == nil && d < 0 {
+		err = fmt.Errorf("can't be negative")
+	}
+	return d, err
+}
+
+func (t Tiers) String() string {
+	specs := make([]string, len(t))
+	for i, c := range t {
+		specs[i] = c.Tier.String()
+		if c.Retention != Forever {
+			specs[i] += ":" + c.Retention.String()
+		}
+	}
+	return strings.Join(specs, ",")
+}
+
+// index of the given tier, -1 if not enabled
+func (t Tiers) index(tier Tier) int {
+	for i, c := range t {
+		if c.Tier == tier {
+			return i
+		}
+	}
+	return -1
+}
+
+// nextRollup returns when the next period of a rolled up tier can be rolled
+// up, after its grace period
+func (t Tiers) nextRollup(now time.Time, grace time.Duration) time.Time {
+	var next time.Time
+	for _, c := range t[1:] {
+		at := c.Tier.start(now).Add(grace)
+		if !at.After(now) {
+			at = c.Tier.next(c.Tier.start(now)).Add(grace)
+		}
+		if next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+	return next
+}
+
+// daysIn return the number of days in a given month
+func daysIn(m time.Month, year int) int {
+	return time.Date(year, m+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
@@ -0,0 +1,222 @@
+package distinctname
+
+import (
+	"strings"
+	"time"
+
+	"gopkg.in/redis.v3"
+)
+
+// Prefixes of the indexes of unique users and of their HyperLogLogs, which
+// have their own namespace so they can't clash with index status keys
+const (
+	usersPrefix    = "metrics:dn:users:"
+	usersLogPrefix = "metrics:dn:users:hll:"
+)
+
+// usersName returns the name of the index of the metrics with unique users
+// counted in the period of tier containing t, ie.
+// `metrics:dn:users:2016-05-04`. Users of each metric are estimated with a
+// HyperLogLog, see usersLogName
+func usersName(tier Tier, t time.Time) string {
+	return usersPrefix + t.Format(tierFormats[tier])
+}
+
+// usersLogName returns the name of the HyperLogLog of metric in the period
+// indexed by index, ie. `metrics:dn:users:hll:2016-05-04:kite_call`
+func usersLogName(index, metric string) string {
+	return usersLogPrefix + strings.TrimPrefix(index, usersPrefix) + ":" + metric
+}
+
+// usersLogLua defines hll(index, metric), which returns usersLogName
+const usersLogLua = `
+local function hll(index, metric)
+	return "metrics:dn:users:hll:" .. string.sub(index, #"metrics:dn:users:" + 1) .. ":" .. metric
+end
+`
+
+// usersScript counts the user ARGV[2] of metric ARGV[1] in the coarsest
+// period already rolled up for its time, and in the finer indexes still
+// there, the same way lateScript does. KEYS are the index and HyperLogLog of
+// the finest tier, then the status, index and HyperLogLog of each coarser
+// tier
+var usersScript = redis.NewScript(`
+local index, users, finer = KEYS[1], KEYS[2], {}
+for i = 3, #KEYS, 3 do
+	if redis.call("EXISTS", KEYS[i]) == 0 then
+		break
+	end
+	finer[#finer + 1] = {index, users}
+	index, users = KEYS[i + 1], KEYS[i + 2]
+end
+redis.call("SADD", index, ARGV[1])
+redis.call("PFADD", users, ARGV[2])
+for _, f in ipairs(finer) do
+	if redis.call("EXISTS", f[1]) == 1 then
+		redis.call("SADD", f[1], ARGV[1])
+		redis.call("PFADD", f[2], ARGV[2])
+	end
+end
+return 1
+`)
+
+// consolidateUsersScript merges the HyperLogLogs of the finer indexes
+// (KEYS[3..]) into those of the coarser one (KEYS[1]), the same way
+// consolidateScript merges sets. HyperLogLogs are not keys of the script,
+// their names are built from the indexes (see usersLogName), so it doesn't
+// work in Redis Cluster.
+// ARGV: consolidation time (RFC 3339), instance, force and keep finer
+// indexes ("1" or "0"), expiration of the coarser index (unix time, empty if
+// none), then the expiration of each finer index.
+// Returns {done, coarser index metrics before, after, finer indexes merged}
+var consolidateUsersScript = redis.NewScript(usersLogLua + `
+local force, keep = ARGV[3] == "1", ARGV[4] == "1"
+local before = redis.call("SCARD", KEYS[1])
+if not force and redis.call("EXISTS", KEYS[2]) == 1 then
+	return {0, before, before, 0}
+end
+local merged = 0
+for i = 3, #KEYS do
+	merged = merged + redis.call("EXISTS", KEYS[i])
+end
+if merged == 0 and force then
+	return {-1, before, before, 0}
+end
+if force then
+	for _, metric in ipairs(redis.call("SMEMBERS", KEYS[1])) do
+		redis.call("DEL", hll(KEYS[1], metric))
+	end
+	redis.call("DEL", KEYS[1])
+end
+for i = 3, #KEYS do
+	local expire = not keep and ARGV[i + 3] ~= ""
+	for _, metric in ipairs(redis.call("SMEMBERS", KEYS[i])) do
+		redis.call("SADD", KEYS[1], metric)
+		redis.call("PFMERGE", hll(KEYS[1], metric), hll(KEYS[i], metric))
+		if expire then
+			redis.call("EXPIREAT", hll(KEYS[i], metric), ARGV[i + 3])
+		end
+	end
+	if expire then
+		redis.call("EXPIREAT", KEYS[i], ARGV[i + 3])
+	end
+end
+if ARGV[5] ~= "" then
+	for _, metric in ipairs(redis.call("SMEMBERS", KEYS[1])) do
+		redis.call("EXPIREAT", hll(KEYS[1], metric), ARGV[5])
+	end
+	redis.call("EXPIREAT", KEYS[1], ARGV[5])
+end
+local after = redis.call("SCARD", KEYS[1])
+redis.call("HMSET", KEYS[2],
+	"consolidated_at", ARGV[1],
+	"instance", ARGV[2],
+	"merged", merged,
+	"metrics", after,
+	"forced", ARGV[3],
+	"kept", ARGV[4])
+return {1, before, after, merged}
+`)
+
+// insertUser counts username as a user of metric in the period containing
+// t, see usersScript
+func (p DistinctName) insertUser(t time.Time, metric, username string) error {
+	finest := p.tiers[0]
+	index := usersName(finest.Tier, t)
+	keys := []string{index, usersLogName(index, metric)}
+
+	if len(p.tiers) > 1 {
+		// Late events may arrive after their period was rolled up
+		if t.Before(p.tiers[1].Tier.start(time.Now().In(p.loc))) {
+			for _, c := range p.tiers[1:] {
+				coarse := usersName(c.Tier, t)
+				keys = append(keys, statusName(coarse), coarse, usersLogName(coarse, metric))
+			}
+		}
+	}
+
+	if err := usersScript.Run(p.client, keys, []string{metric, username}).Err(); err != nil {
+		return err
+	}
+
+	// A single tier is never rolled up, expire it right away
+	if at := finest.expireAt(finest.Tier.start(t)); len(p.tiers) == 1 && !at.IsZero() {
+		if err := p.client.ExpireAt(keys[1], at).Err(); err != nil {
+			return err
+		}
+		return p.client.ExpireAt(index, at).Err()
+	}
+	return nil
+}
+
+// ConsolidateUsers merges the unique users of the finer periods of the
+// period of the given tier containing t (in the reporting timezone loc), see
+// Consolidate
+func ConsolidateUsers(url string, loc *time.Location, tiers Tiers, tier Tier, t time.Time, opts ConsolidateOptions) (ConsolidateReport, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     url,
+		Password: "",
+		DB:       0,
+	})
+	defer client.Close()
+
+	if err := client.Ping().Err(); err != nil {
+		log.Errorf("Error connecting to Redis: %s", err)
+		return ConsolidateReport{}, err
+	}
+	return consolidateUsers(client, loc, tiers, tier, t, opts)
+}
+
+func consolidateUsers(client *redis.Client, loc *time.Location, tiers Tiers, tier Tier, t time.Time, opts ConsolidateOptions) (ConsolidateReport, error) {
+	i, start, err := rolledUpPeriod(loc, tiers, tier, t, time.Now(), opts.Grace)
+	if err != nil {
+		return ConsolidateReport{}, err
+	}
+	c := periodConsolidation(tiers, i, start, usersName)
+
+	if opts.DryRun {
+		return dryConsolidateUsers(client, c.keys, opts)
+	}
+	return c.run(client, consolidateUsersScript, opts)
+}
+
+// dryConsolidateUsers computes the report of consolidating the unique users
+// of the given indexes without changing them
+func dryConsolidateUsers(client *redis.Client, keys []string, opts ConsolidateOptions) (ConsolidateReport, error) {
+	report := ConsolidateReport{Set: keys[0]}
+	var err error
+	if report.Before, err = client.SCard(keys[0]).Result(); err != nil {
+		return report, err
+	}
+	report.After = report.Before
+
+	consolidated, err := client.Exists(keys[1]).Result()
+	if err != nil || (consolidated && !opts.Force) {
+		return report, err
+	}
+
+	indexes := keys[2:]
+	if !opts.Force {
+		indexes = append([]string{keys[0]}, indexes...)
+	}
+	for _, index := range keys[2:] {
+		exists, err := client.Exists(index).Result()
+		if err != nil {
+			return report, err
+		}
+		if exists {
+			report.Merged++
+		}
+	}
+	if report.Merged == 0 && opts.Force {
+		return report, ErrNoFinerSets
+	}
+
+	metrics, err := client.SUnion(indexes...).Result()
+	if err != nil {
+		return report, err
+	}
+	report.Consolidated = true
+	report.After = int64(len(metrics))
+	return report, nil
+}
@@ -0,0 +1,124 @@
+package workers
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/exekias/metric-collector/queue"
+)
+
+// Health checks the broker and the backends of the workers in this process,
+// serving the results for orchestrators. /healthz (liveness) only fails if
+// the broker can't be reached, as restarting the process won't fix a backend.
+// /readyz also fails if a backend can't be reached or a circuit breaker is
+// not closed
+type Health struct {
+	sync.Mutex
+	channel queue.Channel
+	// processors by queue
+	processors map[string]MetricDataProcessor
+}
+
+// NewHealth returns health checks for the given channel, workers are added
+// with Add
+func NewHealth(channel queue.Channel) *Health {
+	return &Health{
+		channel:    channel,
+		processors: make(map[string]MetricDataProcessor),
+	}
+}
+
+// Add a worker consuming from queue with the given processor
+func (h *Health) Add(queue string, processor MetricDataProcessor) {
+	h.Lock()
+	h.processors[queue] = processor
+	h.Unlock()
+}
+
+// Register the health endpoints in mux
+func (h *Health) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		serveChecks(w, h.Healthy())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		serveChecks(w, h.Ready())
+	})
+}
+
+// Healthy checks the broker, returns the result of every check by name, nil
+// if it passed
+func (h *Health) Healthy() map[string]error {
+	return waitChecks(h.checks(false))
+}
+
+// Ready checks the broker and the backends, plus the circuit breaker of
+// every worker
+func (h *Health) Ready() map[string]error {
+	res := waitChecks(h.checks(true))
+
+	h.Lock()
+	defer h.Unlock()
+	for q := range h.processors {
+		if state := breakerState(q); state != BreakerClosed {
+			res[q+" breaker"] = fmt.Errorf("Circuit %s", state)
+		} else {
+			res[q+" breaker"] = nil
+		}
+	}
+	return res
+}
+
+// checks starts the broker check, and the backend ones if asked to
+func (h *Health) checks(backends bool) map[string]<-chan error {
+	checks := make(map[string]<-chan error)
+	if checker, ok := h.channel.(HealthChecker); ok {
+		checks["broker"] = checkAsync(checker.Check)
+	}
+	if !backends {
+		return checks
+	}
+
+	h.Lock()
+	for q, p := range h.processors {
+		p := p
+		checks[q] = checkAsync(func() error { return Check(p) })
+	}
+	h.Unlock()
+
+	return checks
+}
+
+// breakerState returns the circuit breaker state for the given queue, closed
+// if the worker didn't start yet
+func breakerState(q string) string {
+	if state, ok := breakerStates.Get(q).(*expvar.String); ok {
+		return state.Value()
+	}
+	return BreakerClosed
+}
+
+// serveChecks writes a line per check, failing with 503 if any failed
+func serveChecks(w http.ResponseWriter, checks map[string]error) {
+	names := make([]string, 0, len(checks))
+	status := http.StatusOK
+	for name, err := range checks {
+		names = append(names, name)
+		if err != nil {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	for _, name := range names {
+		if err := checks[name]; err != nil {
+			fmt.Fprintf(w, "%s: %s\n", name, err)
+		} else {
+			fmt.Fprintf(w, "%s: ok\n", name)
+		}
+	}
+}
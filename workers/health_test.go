@@ -0,0 +1,71 @@
+package workers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/exekias/metric-collector/queue"
+)
+
+// Helper processor with a failing backend
+type Unhealthy struct {
+	Debug
+}
+
+func (u Unhealthy) Check() error {
+	return errors.New("unreachable")
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	channel := queue.Dummy()
+	health := NewHealth(channel)
+	health.Add("healthy", Debug{})
+	mux := http.NewServeMux()
+	health.Register(mux)
+
+	get := func(path string) int {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Code
+	}
+
+	if code := get("/healthz"); code != http.StatusOK {
+		t.Errorf("Expected /healthz to pass, got %d", code)
+	}
+	if code := get("/readyz"); code != http.StatusOK {
+		t.Errorf("Expected /readyz to pass, got %d", code)
+	}
+
+	// Breaker open
+	b := newBreaker("healthy", BreakerOptions{Window: 1})
+	b.record(false, false)
+	if code := get("/healthz"); code != http.StatusOK {
+		t.Errorf("Expected /healthz to pass with open circuit, got %d", code)
+	}
+	if code := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected /readyz to fail with open circuit, got %d", code)
+	}
+
+	// Backend down
+	health.Add("unhealthy", Unhealthy{})
+	if code := get("/healthz"); code != http.StatusOK {
+		t.Errorf("Expected /healthz to pass with a backend down, got %d", code)
+	}
+	if code := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected /readyz to fail with a backend down, got %d", code)
+	}
+
+	// Broker down
+	health = NewHealth(channel)
+	mux = http.NewServeMux()
+	health.Register(mux)
+	channel.Close()
+	if code := get("/healthz"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected /healthz to fail when the broker is disconnected, got %d", code)
+	}
+	if code := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected /readyz to fail when the broker is disconnected, got %d", code)
+	}
+}
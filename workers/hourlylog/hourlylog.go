@@ -1,7 +1,6 @@
 package hourlylog
 
 import (
-	"fmt"
 	"time"
 
 	"gopkg.in/mgo.v2"
@@ -20,16 +19,19 @@ type HourlyLog struct {
 }
 
 type mongoMetric struct {
-	queue.MetricData `bson:",inline"`
-	Time             time.Time
+	Username string
+	Count    int64
+	Metric   string
+	Tags     map[string]string `bson:",omitempty"`
+	Time     time.Time
 }
 
 // NewHourlyLog intializes and returns a new hourly log processor
 func NewHourlyLog(url, db, collection string) (*HourlyLog, error) {
-	log.Debug(fmt.Sprintf("Connecting to MongoDB (%s)", url))
+	log.Debugf("Connecting to MongoDB (%s)", url)
 	session, err := mgo.Dial(url)
 	if err != nil {
-		log.Error("Error connecting to MongoDB")
+		log.Errorf("Error connecting to MongoDB: %s", err)
 		return nil, err
 	}
 	return initHourlyLog(session, db, collection)
@@ -46,7 +48,7 @@ func initHourlyLog(session *mgo.Session, db, collection string) (*HourlyLog, err
 		ExpireAfter: 1 * time.Hour,
 	}
 	if err := processor.collection.EnsureIndex(index); err != nil {
-		log.Error("Error configuring MongoDB indexes")
+		log.Errorf("Error configuring MongoDB indexes: %s", err)
 		return nil, err
 	}
 
@@ -55,13 +57,30 @@ func initHourlyLog(session *mgo.Session, db, collection string) (*HourlyLog, err
 
 // Process data from the queue
 func (h HourlyLog) Process(d queue.MetricData) error {
-	return h.insert(&mongoMetric{d, time.Now()})
+	return h.insert(&mongoMetric{
+		Username: d.Username,
+		Count:    d.Count,
+		Metric:   d.Metric,
+		Tags:     d.Tags,
+		Time:     d.EventTime(),
+	})
 }
 
 func (h HourlyLog) insert(data *mongoMetric) error {
 	if err := h.collection.Insert(data); err != nil {
-		log.Error("Error storing data in MongoDB:", err)
+		log.Errorf("Error storing data in MongoDB: %s", err)
 		return err
 	}
 	return nil
 }
+
+// Check the MongoDB connection
+func (h HourlyLog) Check() error {
+	return h.collection.Database.Session.Ping()
+}
+
+// Close the MongoDB session
+func (h HourlyLog) Close() error {
+	h.collection.Database.Session.Close()
+	return nil
+}
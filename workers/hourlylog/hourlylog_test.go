@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/exec"
 	"testing"
+	"time"
 
 	"gopkg.in/mgo.v2/dbtest"
 
@@ -46,11 +47,11 @@ func TestHourlyLog(t *testing.T) {
 		t.Error(err)
 	}
 
-	if err = processor.Process(queue.MetricData{"user1", 0, "metric"}); err != nil {
+	if err = processor.Process(queue.MetricData{Username: "user1", Count: 0, Metric: "metric"}); err != nil {
 		t.Error("Processing a metric", err)
 	}
 
-	if err = processor.Process(queue.MetricData{"user2", 1, "metric"}); err != nil {
+	if err = processor.Process(queue.MetricData{Username: "user2", Count: 1, Metric: "metric"}); err != nil {
 		t.Error("Processing a metric", err)
 	}
 
@@ -63,3 +64,36 @@ func TestHourlyLog(t *testing.T) {
 		t.Errorf("Metrics uncorrectly inserted, expected 2, got %d", count)
 	}
 }
+
+func TestHourlyLogEventTime(t *testing.T) {
+	session := server.Session()
+	defer session.Close()
+	processor, err := initHourlyLog(session, "test", "eventtime")
+	if err != nil {
+		t.Error(err)
+	}
+
+	eventTime := time.Now().Add(-10 * time.Minute).UTC().Truncate(time.Millisecond)
+	data := queue.MetricData{
+		Username: "user1",
+		Count:    1,
+		Metric:   "metric",
+		Time:     eventTime,
+		Tags:     map[string]string{"region": "eu"},
+	}
+	if err = processor.Process(data); err != nil {
+		t.Error("Processing a metric", err)
+	}
+
+	var stored mongoMetric
+	if err = session.DB("test").C("eventtime").Find(nil).One(&stored); err != nil {
+		t.Fatal("Getting stored metric", err)
+	}
+
+	if !stored.Time.Equal(eventTime) {
+		t.Errorf("Event time not honored, expected %s, got %s", eventTime, stored.Time)
+	}
+	if stored.Tags["region"] != "eu" {
+		t.Errorf("Tags not stored, got %#v", stored.Tags)
+	}
+}
@@ -0,0 +1,68 @@
+package hourlylog
+
+import (
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/exekias/metric-collector/api"
+)
+
+// Reader queries the events stored by HourlyLog, implements api.EventReader
+type Reader struct {
+	collection *mgo.Collection
+}
+
+// NewReader connects to the MongoDB collection HourlyLog writes to
+func NewReader(url, db, collection string) (*Reader, error) {
+	log.Debugf("Connecting to MongoDB (%s)", url)
+	session, err := mgo.Dial(url)
+	if err != nil {
+		log.Errorf("Error connecting to MongoDB: %s", err)
+		return nil, err
+	}
+	return &Reader{collection: session.DB(db).C(collection)}, nil
+}
+
+// Events returns the latest events matching the query, newest first
+func (r *Reader) Events(q api.EventQuery) ([]api.Event, error) {
+	filter := bson.M{}
+	if q.Username != "" {
+		filter["username"] = q.Username
+	}
+	if q.Metric != "" {
+		filter["metric"] = q.Metric
+	}
+	if !q.From.IsZero() || !q.To.IsZero() {
+		between := bson.M{}
+		if !q.From.IsZero() {
+			between["$gte"] = q.From
+		}
+		if !q.To.IsZero() {
+			between["$lt"] = q.To
+		}
+		filter["time"] = between
+	}
+
+	var res []mongoMetric
+	if err := r.collection.Find(filter).Sort("-time").Limit(q.Limit).All(&res); err != nil {
+		return nil, err
+	}
+
+	events := make([]api.Event, len(res))
+	for i, m := range res {
+		events[i] = api.Event{
+			Username: m.Username,
+			Metric:   m.Metric,
+			Count:    m.Count,
+			Tags:     m.Tags,
+			Time:     m.Time.UTC(),
+		}
+	}
+	return events, nil
+}
+
+// Close the MongoDB session
+func (r *Reader) Close() error {
+	r.collection.Database.Session.Close()
+	return nil
+}
@@ -0,0 +1,21 @@
+package hourlylog
+
+import (
+	"github.com/exekias/metric-collector/constants"
+	"github.com/exekias/metric-collector/workers"
+)
+
+func init() {
+	workers.Register("hourlylog", workers.Factory{
+		Description: "stores the metrics of the last hour in MongoDB",
+		Queue:       constants.Queues["hourlylog"],
+		Settings: []workers.Setting{
+			{Name: "MONGO_URL", Default: "localhost:27017", Description: "MongoDB server"},
+			{Name: "MONGO_DATABASE", Default: "metrics", Description: "MongoDB database"},
+			{Name: "MONGO_COLLECTION", Default: "hourly", Description: "MongoDB collection"},
+		},
+		New: func(c workers.Config) (workers.MetricDataProcessor, error) {
+			return NewHourlyLog(c.Get("MONGO_URL"), c.Get("MONGO_DATABASE"), c.Get("MONGO_COLLECTION"))
+		},
+	})
+}
@@ -0,0 +1,129 @@
+package workers
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/exekias/metric-collector/queue"
+)
+
+// Consumption stats by queue name
+var (
+	numConsumed     = expvar.NewMap("consumed")
+	numAcked        = expvar.NewMap("acked")
+	numRequeued     = expvar.NewMap("requeued")
+	numDeadLettered = expvar.NewMap("dead_lettered")
+)
+
+// delivery wraps a metric message ensuring it's only acked/nacked once, so a
+// processor finishing after its message was nacked on shutdown won't ack it
+type delivery struct {
+	queue.MetricMessage
+	mu       sync.Mutex
+	settled  bool
+	received time.Time
+	queue    string
+	// trial metric of a half-open breaker
+	trial bool
+}
+
+func (d *delivery) settle(f func() error, stats *expvar.Map) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.settled {
+		return nil
+	}
+	d.settled = true
+	stats.Add(d.queue, 1)
+	return f()
+}
+
+// Ack acknowledges the message unless it was already settled
+func (d *delivery) Ack() error {
+	return d.settle(d.MetricMessage.Ack, numAcked)
+}
+
+// Nack negatively acknowledges the message unless it was already settled
+func (d *delivery) Nack() error {
+	return d.settle(d.MetricMessage.Nack, numRequeued)
+}
+
+// Requeue the message without spending an attempt, unless it was already
+// settled
+func (d *delivery) Requeue() error {
+	return d.settle(d.MetricMessage.Requeue, numRequeued)
+}
+
+// Reject the message unless it was already settled
+func (d *delivery) Reject() error {
+	return d.settle(d.MetricMessage.Reject, numDeadLettered)
+}
+
+// deliveryTag returns the broker delivery tag of the message, if it has one
+func deliveryTag(m queue.MetricMessage) (uint64, bool) {
+	if tagged, ok := m.(interface {
+		DeliveryTag() uint64
+	}); ok {
+		return tagged.DeliveryTag(), true
+	}
+	return 0, false
+}
+
+// inflight keeps track of metrics being processed, so they can be drained on
+// shutdown
+type inflight struct {
+	sync.Mutex
+	wg       sync.WaitGroup
+	queue    string
+	messages map[*delivery]struct{}
+}
+
+func newInflight(queue string) *inflight {
+	return &inflight{queue: queue, messages: make(map[*delivery]struct{})}
+}
+
+// add starts tracking the given message
+func (p *inflight) add(m queue.MetricMessage) *delivery {
+	d := &delivery{MetricMessage: m, received: time.Now(), queue: p.queue}
+	numConsumed.Add(p.queue, 1)
+	p.Lock()
+	p.messages[d] = struct{}{}
+	p.Unlock()
+	p.wg.Add(1)
+	return d
+}
+
+// done stops tracking the given message
+func (p *inflight) done(d *delivery) {
+	p.Lock()
+	delete(p.messages, d)
+	p.Unlock()
+	p.wg.Done()
+}
+
+// drain waits until all tracked messages are done or timeout expires, in
+// that case remaining messages are requeued, without spending an attempt as
+// they didn't fail
+func (p *inflight) drain(timeout time.Duration) {
+	finished := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return
+	case <-time.After(timeout):
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	log.Warningf("%d metrics still in-flight after %s, requeuing them", len(p.messages), timeout)
+	for d := range p.messages {
+		if err := d.Requeue(); err != nil {
+			log.Errorf("Could not requeue in-flight metric: %s", err)
+		}
+	}
+}
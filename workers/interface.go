@@ -1,6 +1,12 @@
 package workers
 
-import "github.com/exekias/metric-collector/queue"
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/exekias/metric-collector/queue"
+)
 
 // MetricDataProcessor processes/stores MetricData messages
 type MetricDataProcessor interface {
@@ -8,3 +14,94 @@ type MetricDataProcessor interface {
 	// Process given MetricData
 	Process(data queue.MetricData) error
 }
+
+// Close releases resources held by the given processor, if it implements
+// io.Closer
+func Close(p MetricDataProcessor) error {
+	if closer, ok := p.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// HealthChecker is implemented by processors able to check their backend
+type HealthChecker interface {
+	// Check returns an error if the backend is unreachable
+	Check() error
+}
+
+// Check the backend of the given processor, if it implements HealthChecker
+func Check(p MetricDataProcessor) error {
+	if checker, ok := p.(HealthChecker); ok {
+		return checker.Check()
+	}
+	return nil
+}
+
+// HTTPHandler is implemented by processors serving an endpoint in the stats
+// server, in /debug/<processor name>
+type HTTPHandler interface {
+	Handler() http.Handler
+}
+
+// Handler returns the endpoint of the given processor, nil if it doesn't
+// implement HTTPHandler
+func Handler(p MetricDataProcessor) http.Handler {
+	if handler, ok := p.(HTTPHandler); ok {
+		return handler.Handler()
+	}
+	return nil
+}
+
+// invalidCounter is implemented by processors keeping count of invalid
+// metrics, see StatsProcessor
+type invalidCounter interface {
+	CountInvalid()
+}
+
+func countInvalid(p MetricDataProcessor) {
+	if counter, ok := p.(invalidCounter); ok {
+		counter.CountInvalid()
+	}
+}
+
+// ConcurrencyHinter is implemented by processors preferring a given number
+// of metrics processed at the same time, ie. 1 to process them in order.
+// Options.Concurrency takes precedence over it
+type ConcurrencyHinter interface {
+	// Concurrency returns the preferred pool size, 0 for no preference
+	Concurrency() int
+}
+
+func concurrencyHint(p MetricDataProcessor) int {
+	if hinter, ok := p.(ConcurrencyHinter); ok {
+		return hinter.Concurrency()
+	}
+	return 0
+}
+
+// poolObserver is implemented by processors keeping stats of the worker
+// pool, see StatsProcessor
+type poolObserver interface {
+	ObservePoolSize(size int)
+	ObserveStart(wait time.Duration)
+	ObserveDone()
+}
+
+func observePoolSize(p MetricDataProcessor, size int) {
+	if observer, ok := p.(poolObserver); ok {
+		observer.ObservePoolSize(size)
+	}
+}
+
+func observeStart(p MetricDataProcessor, wait time.Duration) {
+	if observer, ok := p.(poolObserver); ok {
+		observer.ObserveStart(wait)
+	}
+}
+
+func observeDone(p MetricDataProcessor) {
+	if observer, ok := p.(poolObserver); ok {
+		observer.ObserveDone()
+	}
+}
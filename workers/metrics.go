@@ -0,0 +1,135 @@
+package workers
+
+import (
+	"errors"
+	"expvar"
+	"time"
+
+	"github.com/exekias/metric-collector/metrics"
+)
+
+// checkTimeout is the time given to backends to answer health checks
+const checkTimeout = 2 * time.Second
+
+// ErrCheckTimeout is the result of health checks not answering in time
+var ErrCheckTimeout = errors.New("Health check timed out")
+
+func init() {
+	metrics.Register(collectProcessors)
+	metrics.Register(collectQueues)
+}
+
+// collectProcessors writes stats of all StatsProcessors by name
+func collectProcessors(w *metrics.Writer) {
+	processors.Lock()
+	snapshots := make(map[string]StatsSnapshot, len(processors.stats))
+	checks := make(map[string]<-chan error, len(processors.stats))
+	for name, stats := range processors.stats {
+		snapshots[name] = stats.Snapshot()
+		checks[name] = checkAsync(stats.Check)
+	}
+	processors.Unlock()
+
+	family := func(name, kind, help string, value func(s StatsSnapshot) float64) {
+		w.Family(name, kind, help)
+		for processor, s := range snapshots {
+			w.Sample(name, metrics.Labels{"processor": processor}, value(s))
+		}
+	}
+
+	family("processed_total", metrics.Counter, "Metrics processed",
+		func(s StatsSnapshot) float64 { return float64(s.Metrics) })
+	family("errors_total", metrics.Counter, "Metrics the processor failed to process",
+		func(s StatsSnapshot) float64 { return float64(s.Errors) })
+	family("invalid_total", metrics.Counter, "Metrics that couldn't be decoded or validated",
+		func(s StatsSnapshot) float64 { return float64(s.Invalid) })
+	family("pool_size", metrics.Gauge, "Goroutines in the worker pool",
+		func(s StatsSnapshot) float64 { return float64(s.PoolSize) })
+	family("pool_busy", metrics.Gauge, "Goroutines in the worker pool processing a metric",
+		func(s StatsSnapshot) float64 { return float64(s.PoolBusy) })
+	family("queue_wait_seconds_avg", metrics.Gauge, "Average time metrics wait for a free goroutine",
+		func(s StatsSnapshot) float64 { return s.AvgQueueWait })
+
+	w.Family("processing_seconds", metrics.Histogram, "Time taken to process metrics")
+	for processor, s := range snapshots {
+		w.Histogram("processing_seconds", metrics.Labels{"processor": processor}, latencyBuckets[:], s.latency.Buckets[:], s.latency.Sum)
+	}
+
+	w.Family("metric_processed_total", metrics.Counter, "Metrics processed by metric name")
+	for processor, s := range snapshots {
+		for metric, m := range s.ByMetric {
+			w.Sample("metric_processed_total", metrics.Labels{"processor": processor, "metric": metric}, float64(m.Metrics))
+		}
+	}
+	w.Family("metric_errors_total", metrics.Counter, "Metrics the processor failed to process by metric name")
+	for processor, s := range snapshots {
+		for metric, m := range s.ByMetric {
+			w.Sample("metric_errors_total", metrics.Labels{"processor": processor, "metric": metric}, float64(m.Errors))
+		}
+	}
+
+	w.Family("backend_up", metrics.Gauge, "Whether the processor backend answers health checks")
+	for processor, err := range waitChecks(checks) {
+		value := 0.0
+		if err == nil {
+			value = 1
+		} else {
+			log.Warningf("Health check for '%s' failed: %s", processor, err)
+		}
+		w.Sample("backend_up", metrics.Labels{"processor": processor}, value)
+	}
+}
+
+// checkAsync runs the given health check in the background
+func checkAsync(check func() error) <-chan error {
+	res := make(chan error, 1)
+	go func() { res <- check() }()
+	return res
+}
+
+// collectQueues writes consumption and circuit breaker stats by queue
+func collectQueues(w *metrics.Writer) {
+	counter := func(name, help string, m *expvar.Map) {
+		w.Family(name, metrics.Counter, help)
+		m.Do(func(kv expvar.KeyValue) {
+			w.Sample(name, metrics.Labels{"queue": kv.Key}, float64(kv.Value.(*expvar.Int).Value()))
+		})
+	}
+
+	counter("consumed_total", "Metrics received from the queue", numConsumed)
+	counter("acked_total", "Metrics acknowledged", numAcked)
+	counter("requeued_total", "Metrics requeued to be retried", numRequeued)
+	counter("dead_lettered_total", "Metrics sent to the dead-letter queue", numDeadLettered)
+	counter("breaker_transitions_total", "Circuit breaker state changes", breakerTransitions)
+
+	w.Family("breaker_state", metrics.Gauge, "Current circuit breaker state (1 for the current one)")
+	breakerStates.Do(func(kv expvar.KeyValue) {
+		current := kv.Value.(*expvar.String).Value()
+		for _, state := range []string{BreakerClosed, BreakerOpen, BreakerHalfOpen} {
+			value := 0.0
+			if state == current {
+				value = 1
+			}
+			w.Sample("breaker_state", metrics.Labels{"queue": kv.Key, "state": state}, value)
+		}
+	})
+}
+
+// waitChecks waits for the given checks by name, those not answering before
+// checkTimeout fail
+func waitChecks(checks map[string]<-chan error) map[string]error {
+	timeout := make(chan struct{})
+	timer := time.AfterFunc(checkTimeout, func() { close(timeout) })
+	defer timer.Stop()
+
+	res := make(map[string]error, len(checks))
+	for name, check := range checks {
+		select {
+		case err := <-check:
+			res[name] = err
+		case <-timeout:
+			res[name] = ErrCheckTimeout
+		}
+	}
+	return res
+}
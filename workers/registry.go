@@ -0,0 +1,136 @@
+package workers
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/exekias/metric-collector/constants"
+)
+
+// Factory describes a processor, so it can be built by name. Processor
+// packages register theirs on init, see Register
+type Factory struct {
+	// Description shown in the usage text
+	Description string
+
+	// Queue consumed by the processor, built-in ones are in constants.Queues
+	Queue constants.Queue
+
+	// Settings required by the processor
+	Settings []Setting
+
+	// New returns a processor for the given config, which holds a value for
+	// every setting
+	New func(config Config) (MetricDataProcessor, error)
+}
+
+// Setting required by a processor, read from the environment variable with
+// the same name or the configuration file (see Resolve). Settings without a
+// default value are mandatory
+type Setting struct {
+	Name        string
+	Default     string
+	Description string
+}
+
+// Config values by setting name
+type Config map[string]string
+
+// Get the value of the given setting
+func (c Config) Get(name string) string {
+	return c[name]
+}
+
+var registry = struct {
+	sync.Mutex
+	factories map[string]Factory
+}{factories: make(map[string]Factory)}
+
+// Register a processor factory with the given name, it panics if the name is
+// already registered
+func Register(name string, factory Factory) {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, dup := registry.factories[name]; dup {
+		panic(fmt.Sprintf("Processor '%s' registered twice", name))
+	}
+	if factory.New == nil {
+		panic(fmt.Sprintf("Processor '%s' registered without constructor", name))
+	}
+	if factory.Queue.Name == "" {
+		panic(fmt.Sprintf("Processor '%s' registered without queue", name))
+	}
+	registry.factories[name] = factory
+}
+
+// Lookup the factory registered with the given name
+func Lookup(name string) (Factory, bool) {
+	registry.Lock()
+	defer registry.Unlock()
+	factory, ok := registry.factories[name]
+	return factory, ok
+}
+
+// Registered returns the names of all registered processors, sorted
+func Registered() []string {
+	registry.Lock()
+	defer registry.Unlock()
+	names := make([]string, 0, len(registry.factories))
+	for name := range registry.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SettingKey returns the key of a setting in configuration files, its name
+// in lower case
+func SettingKey(name string) string {
+	return strings.ToLower(name)
+}
+
+// Resolve the value of the given settings, from their environment variable,
+// values (by SettingKey) or default, in that order. It fails if a mandatory
+// one is missing
+func Resolve(settings []Setting, values map[string]string) (Config, error) {
+	config := make(Config, len(settings))
+	var missing []string
+	for _, s := range settings {
+		value := os.Getenv(s.Name)
+		if value == "" {
+			value = values[SettingKey(s.Name)]
+		}
+		if value == "" {
+			value = s.Default
+		}
+		if value == "" {
+			missing = append(missing, SettingKey(s.Name))
+		}
+		config[s.Name] = value
+	}
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("Missing settings: %s", strings.Join(missing, ", "))
+	}
+	return config, nil
+}
+
+// New builds the processor with the given name, see Resolve for how its
+// settings are read
+func New(name string, values map[string]string) (MetricDataProcessor, Factory, error) {
+	factory, ok := Lookup(name)
+	if !ok {
+		return nil, factory, fmt.Errorf("Unknown processor '%s'", name)
+	}
+
+	config, err := Resolve(factory.Settings, values)
+	if err != nil {
+		return nil, factory, fmt.Errorf("Processor '%s': %s", name, err)
+	}
+
+	processor, err := factory.New(config)
+	return processor, factory, err
+}
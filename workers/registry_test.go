@@ -0,0 +1,43 @@
+package workers
+
+import (
+	"os"
+	"testing"
+
+	"github.com/exekias/metric-collector/constants"
+)
+
+func TestRegistryResolvesSettings(t *testing.T) {
+	Register("test_registry", Factory{
+		Queue: constants.Queue{Name: "test_queue"},
+		Settings: []Setting{
+			{Name: "TEST_REGISTRY_URL", Default: "localhost"},
+			{Name: "TEST_REGISTRY_TOKEN"},
+		},
+		New: func(c Config) (MetricDataProcessor, error) {
+			if c.Get("TEST_REGISTRY_URL") != "localhost" || c.Get("TEST_REGISTRY_TOKEN") != "secret" {
+				t.Errorf("Unexpected config %v", c)
+			}
+			return Failing{}, nil
+		},
+	})
+
+	if _, _, err := New("test_registry", nil); err == nil {
+		t.Error("Expected an error for a missing mandatory setting")
+	}
+
+	// Environment takes precedence over values
+	os.Setenv("TEST_REGISTRY_TOKEN", "secret")
+	defer os.Unsetenv("TEST_REGISTRY_TOKEN")
+	_, factory, err := New("test_registry", map[string]string{"test_registry_token": "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if factory.Queue.Name != "test_queue" {
+		t.Errorf("Expected queue test_queue, got %s", factory.Queue.Name)
+	}
+
+	if _, _, err := New("unknown", nil); err == nil {
+		t.Error("Expected an error for an unknown processor")
+	}
+}
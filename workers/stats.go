@@ -2,6 +2,7 @@ package workers
 
 import (
 	"expvar"
+	"net/http"
 	"sync"
 	"time"
 
@@ -9,38 +10,146 @@ import (
 )
 
 var (
-	numMetrics     = expvar.NewInt("n_metrics")
-	numErrors      = expvar.NewInt("n_errors")
-	avgCount       = expvar.NewFloat("avg_count")
-	avgProcessTime = expvar.NewFloat("avg_process_time") // in seconds
+	numMetrics      = expvar.NewInt("n_metrics")
+	numErrors       = expvar.NewInt("n_errors")
+	numInvalid      = expvar.NewInt("n_invalid")
+	avgCount        = expvar.NewFloat("avg_count")
+	avgProcessTime  = expvar.NewFloat("avg_process_time") // in seconds
+	latencyP50      = expvar.NewFloat("latency_p50")      // in seconds, last minute
+	latencyP95      = expvar.NewFloat("latency_p95")      // in seconds, last minute
+	latencyP99      = expvar.NewFloat("latency_p99")      // in seconds, last minute
+	rate1m          = expvar.NewFloat("rate_1m")          // metrics per second
+	rate5m          = expvar.NewFloat("rate_5m")          // metrics per second
+	poolSize        = expvar.NewInt("pool_size")
+	poolBusy        = expvar.NewInt("pool_busy")
+	poolUtilization = expvar.NewFloat("pool_utilization") // busy / size
+	avgQueueWait    = expvar.NewFloat("avg_queue_wait")   // in seconds
 )
 
+// Sliding windows, stats are kept for the last 5 minutes in 10s slots
+const (
+	statsSlot     = 10 * time.Second
+	statsSlots    = 30
+	shortWindow   = time.Minute
+	longWindow    = 5 * time.Minute
+	maxMetricKeys = 100
+	otherMetrics  = "_other"
+)
+
+// processors publishes a breakdown of every StatsProcessor by name
+var processors = struct {
+	sync.Mutex
+	stats map[string]*StatsProcessor
+}{stats: make(map[string]*StatsProcessor)}
+
+func init() {
+	expvar.Publish("processors", expvar.Func(func() interface{} {
+		processors.Lock()
+		defer processors.Unlock()
+		res := make(map[string]StatsSnapshot, len(processors.stats))
+		for name, stats := range processors.stats {
+			res[name] = stats.Snapshot()
+		}
+		return res
+	}))
+}
+
 // StatsProcessor wraps another processor and stores stats of it
 // How many requests were handled? How long did they take? What are our
 // average values? etc.
 type StatsProcessor struct {
-	// Mutex *for writting*, we can affort unconsistent reads
+	// Mutex guarding all fields, hold it to read them consistently
 	sync.Mutex
+	// Name of the processor
+	Name string
 	// NumMetrics processed
 	NumMetrics int64
-	// NumErrors that happened
+	// NumErrors returned by the processor
 	NumErrors int64
+	// NumInvalid metrics that couldn't be decoded or validated
+	NumInvalid int64
 	// AvgCount from all metrics
 	AvgCount float64
-	// AvgProcessTime in seconds
+	// AvgProcessTime in seconds, since start. See Snapshot for recent latencies
 	AvgProcessTime float64
+	// Latency of all processed metrics
+	Latency histogram
+	// PoolSize of the worker running this processor
+	PoolSize int64
+	// PoolBusy goroutines, processing a metric
+	PoolBusy int64
+	// AvgQueueWait in seconds, from metric reception to processing start
+	AvgQueueWait float64
+	// numStarted metrics, for AvgQueueWait
+	numStarted int64
 	// Publish stats in expvars? Only one statsprocessor should do this at a time
 	public bool
 
+	// recent results, in total and by metric name
+	recent   *window
+	byMetric map[string]*metricStats
+
 	processor MetricDataProcessor
 }
 
-// Stats wraps a given processor and stores stats on processed metrics
-func Stats(p MetricDataProcessor, public bool) MetricDataProcessor {
-	return &StatsProcessor{
+// metricStats for a single metric name
+type metricStats struct {
+	count  int64
+	errors int64
+	recent *window
+}
+
+// StatsSnapshot is a consistent copy of the stats of a processor
+type StatsSnapshot struct {
+	Metrics        int64   `json:"n_metrics"`
+	Errors         int64   `json:"n_errors"`
+	Invalid        int64   `json:"n_invalid"`
+	AvgCount       float64 `json:"avg_count"`
+	AvgProcessTime float64 `json:"avg_process_time"`
+	RecentStats
+	PoolSize        int64                  `json:"pool_size"`
+	PoolBusy        int64                  `json:"pool_busy"`
+	PoolUtilization float64                `json:"pool_utilization"`
+	AvgQueueWait    float64                `json:"avg_queue_wait"`
+	ByMetric        map[string]MetricStats `json:"by_metric"`
+
+	// latency of all processed metrics
+	latency histogram
+}
+
+// RecentStats computed over sliding windows, latencies over the last minute
+type RecentStats struct {
+	LatencyP50 float64 `json:"latency_p50"`
+	LatencyP95 float64 `json:"latency_p95"`
+	LatencyP99 float64 `json:"latency_p99"`
+	Rate1m     float64 `json:"rate_1m"`
+	Rate5m     float64 `json:"rate_5m"`
+	ErrorRate  float64 `json:"error_rate_1m"` // errors / metrics
+}
+
+// MetricStats for a single metric name
+type MetricStats struct {
+	Metrics int64 `json:"n_metrics"`
+	Errors  int64 `json:"n_errors"`
+	RecentStats
+}
+
+// Stats wraps a given processor and stores stats on processed metrics,
+// published by name in the `processors` expvar
+func Stats(name string, p MetricDataProcessor, public bool) MetricDataProcessor {
+	stats := &StatsProcessor{
+		Name:      name,
 		processor: p,
 		public:    public,
+		recent:    newWindow(statsSlot, statsSlots),
+		byMetric:  make(map[string]*metricStats),
 	}
+
+	processors.Lock()
+	processors.stats[name] = stats
+	processors.Unlock()
+
+	return stats
 }
 
 // Process using wrapped worker and store stats on the result
@@ -51,25 +160,188 @@ func (stats *StatsProcessor) Process(d queue.MetricData) error {
 	err := stats.processor.Process(d)
 
 	// Store stats
+	now := time.Now()
+	latency := now.Sub(start).Seconds()
+	failed := err != nil
+
 	stats.Lock()
+	defer stats.Unlock()
 	stats.AvgCount = nextAvg(stats.AvgCount, stats.NumMetrics, float64(d.Count))
-	stats.AvgProcessTime = nextAvg(stats.AvgProcessTime, stats.NumMetrics, time.Since(start).Seconds())
+	stats.AvgProcessTime = nextAvg(stats.AvgProcessTime, stats.NumMetrics, latency)
 	stats.NumMetrics++
-	stats.Unlock()
+	if failed {
+		stats.NumErrors++
+	}
+	stats.Latency.observe(latency)
+	stats.recent.observe(now, latency, failed)
+
+	m := stats.metric(d.Metric)
+	m.count++
+	if failed {
+		m.errors++
+	}
+	m.recent.observe(now, latency, failed)
 
 	// Copy to expvar
-	stats.publish()
+	stats.publish(now)
 
 	return err
 }
 
+// metric returns the stats for the given metric name, must hold the lock
+// Past maxMetricKeys names, new ones are grouped together
+func (stats *StatsProcessor) metric(name string) *metricStats {
+	if m, ok := stats.byMetric[name]; ok {
+		return m
+	}
+	if len(stats.byMetric) >= maxMetricKeys {
+		name = otherMetrics
+		if m, ok := stats.byMetric[name]; ok {
+			return m
+		}
+	}
+	m := &metricStats{recent: newWindow(statsSlot, statsSlots)}
+	stats.byMetric[name] = m
+	return m
+}
+
+// CountInvalid records a metric that couldn't be decoded or validated, so it
+// never reached the processor
+func (stats *StatsProcessor) CountInvalid() {
+	stats.Lock()
+	defer stats.Unlock()
+	stats.NumInvalid++
+	stats.publish(time.Now())
+}
+
+// Close the wrapped processor
+func (stats *StatsProcessor) Close() error {
+	return Close(stats.processor)
+}
+
+// Check the wrapped processor backend, see HealthChecker
+func (stats *StatsProcessor) Check() error {
+	return Check(stats.processor)
+}
+
+// Handler forwards the wrapped processor endpoint, see HTTPHandler
+func (stats *StatsProcessor) Handler() http.Handler {
+	return Handler(stats.processor)
+}
+
+// Concurrency forwards the wrapped processor hint, see ConcurrencyHinter
+func (stats *StatsProcessor) Concurrency() int {
+	return concurrencyHint(stats.processor)
+}
+
+// ObservePoolSize records the size of the worker pool
+func (stats *StatsProcessor) ObservePoolSize(size int) {
+	stats.Lock()
+	defer stats.Unlock()
+	stats.PoolSize = int64(size)
+	stats.publish(time.Now())
+}
+
+// ObserveStart records a pool goroutine starting to process a metric, which
+// waited for the given time since it was received
+func (stats *StatsProcessor) ObserveStart(wait time.Duration) {
+	stats.Lock()
+	defer stats.Unlock()
+	stats.AvgQueueWait = nextAvg(stats.AvgQueueWait, stats.numStarted, wait.Seconds())
+	stats.numStarted++
+	stats.PoolBusy++
+	stats.publish(time.Now())
+}
+
+// ObserveDone records a pool goroutine finishing with a metric
+func (stats *StatsProcessor) ObserveDone() {
+	stats.Lock()
+	defer stats.Unlock()
+	stats.PoolBusy--
+	stats.publish(time.Now())
+}
+
+// Utilization of the worker pool, from 0 (idle) to 1 (all goroutines busy),
+// must hold the lock
+func (stats *StatsProcessor) Utilization() float64 {
+	if stats.PoolSize == 0 {
+		return 0
+	}
+	return float64(stats.PoolBusy) / float64(stats.PoolSize)
+}
+
+// Snapshot returns a consistent copy of the stats
+func (stats *StatsProcessor) Snapshot() StatsSnapshot {
+	stats.Lock()
+	defer stats.Unlock()
+	return stats.snapshot(time.Now())
+}
+
+// snapshot must hold the lock
+func (stats *StatsProcessor) snapshot(now time.Time) StatsSnapshot {
+	s := StatsSnapshot{
+		Metrics:         stats.NumMetrics,
+		Errors:          stats.NumErrors,
+		Invalid:         stats.NumInvalid,
+		AvgCount:        stats.AvgCount,
+		AvgProcessTime:  stats.AvgProcessTime,
+		RecentStats:     recentStats(stats.recent, now),
+		PoolSize:        stats.PoolSize,
+		PoolBusy:        stats.PoolBusy,
+		PoolUtilization: stats.Utilization(),
+		AvgQueueWait:    stats.AvgQueueWait,
+		ByMetric:        make(map[string]MetricStats, len(stats.byMetric)),
+		latency:         stats.Latency,
+	}
+
+	for name, m := range stats.byMetric {
+		s.ByMetric[name] = MetricStats{
+			Metrics:     m.count,
+			Errors:      m.errors,
+			RecentStats: recentStats(m.recent, now),
+		}
+	}
+	return s
+}
+
+func recentStats(w *window, now time.Time) RecentStats {
+	h, errors := w.last(now, shortWindow)
+	r := RecentStats{
+		LatencyP50: h.percentile(0.50),
+		LatencyP95: h.percentile(0.95),
+		LatencyP99: h.percentile(0.99),
+		Rate1m:     w.rate(now, shortWindow),
+		Rate5m:     w.rate(now, longWindow),
+	}
+	if h.Count > 0 {
+		r.ErrorRate = float64(errors) / float64(h.Count)
+	}
+	return r
+}
+
 func nextAvg(current float64, count int64, newVal float64) float64 {
 	return (current*float64(count) + newVal) / float64(count+1)
 }
 
-func (stats *StatsProcessor) publish() {
+// publish stats in the global expvars if public, must hold the lock
+func (stats *StatsProcessor) publish(now time.Time) {
+	if !stats.public {
+		return
+	}
+
+	recent := recentStats(stats.recent, now)
 	numMetrics.Set(stats.NumMetrics)
 	numErrors.Set(stats.NumErrors)
+	numInvalid.Set(stats.NumInvalid)
 	avgCount.Set(stats.AvgCount)
 	avgProcessTime.Set(stats.AvgProcessTime)
+	latencyP50.Set(recent.LatencyP50)
+	latencyP95.Set(recent.LatencyP95)
+	latencyP99.Set(recent.LatencyP99)
+	rate1m.Set(recent.Rate1m)
+	rate5m.Set(recent.Rate5m)
+	poolSize.Set(stats.PoolSize)
+	poolBusy.Set(stats.PoolBusy)
+	poolUtilization.Set(stats.Utilization())
+	avgQueueWait.Set(stats.AvgQueueWait)
 }
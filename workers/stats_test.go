@@ -0,0 +1,51 @@
+package workers
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/exekias/metric-collector/metrics"
+	"github.com/exekias/metric-collector/queue"
+)
+
+func TestStatsCountsErrorsByMetric(t *testing.T) {
+	stats := Stats("failing", Failing{}, false).(*StatsProcessor)
+	stats.Process(queue.MetricData{Username: "user", Metric: "foo"})
+	stats.Process(queue.MetricData{Username: "user", Metric: "foo"})
+	stats.Process(queue.MetricData{Username: "user", Metric: "bar"})
+
+	s := stats.Snapshot()
+	if s.Metrics != 3 || s.Errors != 3 {
+		t.Errorf("Expected 3 metrics and 3 errors, got %d and %d", s.Metrics, s.Errors)
+	}
+	if s.ErrorRate != 1 {
+		t.Errorf("Expected error rate 1, got %f", s.ErrorRate)
+	}
+	if foo := s.ByMetric["foo"]; foo.Metrics != 2 || foo.Errors != 2 {
+		t.Errorf("Expected 2 foo metrics and errors, got %d and %d", foo.Metrics, foo.Errors)
+	}
+	if bar := s.ByMetric["bar"]; bar.Metrics != 1 {
+		t.Errorf("Expected 1 bar metric, got %d", bar.Metrics)
+	}
+}
+
+func TestStatsPrometheusMetrics(t *testing.T) {
+	stats := Stats("prometheus", Failing{}, false)
+	stats.Process(queue.MetricData{Username: "user", Metric: "foo"})
+
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, line := range []string{
+		`metric_collector_errors_total{processor="prometheus"} 1`,
+		`metric_collector_processing_seconds_count{processor="prometheus"} 1`,
+		`metric_collector_metric_processed_total{metric="foo",processor="prometheus"} 1`,
+		`metric_collector_backend_up{processor="prometheus"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expected line %q in:\n%s", line, body)
+		}
+	}
+}
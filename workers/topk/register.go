@@ -0,0 +1,58 @@
+package topk
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/exekias/metric-collector/constants"
+	"github.com/exekias/metric-collector/workers"
+)
+
+func init() {
+	workers.Register("topk", workers.Factory{
+		Description: "keeps the top K users and (user, metric) pairs over sliding windows in memory, served in the stats server",
+		Queue:       constants.Queues["topk"],
+		Settings: []workers.Setting{
+			{Name: "TOPK_K", Default: strconv.Itoa(DefaultK), Description: "Number of users and pairs reported"},
+			{Name: "TOPK_WINDOWS", Default: DefaultWindows, Description: "Sliding windows reported"},
+			{Name: "TOPK_SLOT", Default: DefaultSlot.String(), Description: "Slot windows are split in, old metrics are forgotten a slot at a time"},
+			{Name: "TOPK_STORE", Default: "none", Description: "Store snapshots are saved to (none, file:///path/topk.json or redis://host:port/key)"},
+			{Name: "TOPK_SNAPSHOT_INTERVAL", Default: DefaultSnapshotInterval.String(), Description: "Time between snapshots"},
+		},
+		New: func(c workers.Config) (workers.MetricDataProcessor, error) {
+			opts, err := ParseOptions(c)
+			if err != nil {
+				return nil, err
+			}
+			return NewTopK(opts), nil
+		},
+	})
+}
+
+// ParseOptions reads the processor options from its settings, connecting to
+// its store
+func ParseOptions(c workers.Config) (Options, error) {
+	var opts Options
+	var err error
+	if opts.K, err = strconv.Atoi(c.Get("TOPK_K")); err != nil {
+		return opts, err
+	}
+	if opts.K < 1 {
+		return opts, fmt.Errorf("Invalid TOPK_K %d, it must be positive", opts.K)
+	}
+	if opts.Windows, err = ParseWindows(c.Get("TOPK_WINDOWS")); err != nil {
+		return opts, err
+	}
+	if opts.Slot, err = time.ParseDuration(c.Get("TOPK_SLOT")); err != nil {
+		return opts, err
+	}
+	if opts.SnapshotInterval, err = time.ParseDuration(c.Get("TOPK_SNAPSHOT_INTERVAL")); err != nil {
+		return opts, err
+	}
+	if opts.Slot <= 0 || opts.SnapshotInterval <= 0 {
+		return opts, fmt.Errorf("TOPK_SLOT and TOPK_SNAPSHOT_INTERVAL must be positive")
+	}
+	opts.Store, err = NewStore(c.Get("TOPK_STORE"))
+	return opts, err
+}
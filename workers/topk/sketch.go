@@ -0,0 +1,152 @@
+package topk
+
+import (
+	"container/heap"
+	"sort"
+	"time"
+)
+
+// Counter of an item in a sketch. Count overestimates its occurrences by at
+// most Error
+type Counter struct {
+	Item  string
+	Count int64
+	Error int64
+}
+
+// sketch is a Space-Saving summary (Metwally et al.) of the items with most
+// occurrences, keeping at most capacity counters. When full, a new item
+// takes the counter with the lowest count, inheriting it as error. Items
+// with more than 1/capacity of the occurrences are always kept
+type sketch struct {
+	capacity int
+	counters map[string]*entry
+	byCount  entries
+}
+
+// entry is a counter in the heap of a sketch
+type entry struct {
+	Counter
+	index int
+}
+
+// entries is a min-heap of counters, by count
+type entries []*entry
+
+func (h entries) Len() int           { return len(h) }
+func (h entries) Less(i, j int) bool { return h[i].Count < h[j].Count }
+func (h entries) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+func (h *entries) Push(x interface{}) {
+	e := x.(*entry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+func (h *entries) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+func newSketch(capacity int) *sketch {
+	return &sketch{capacity: capacity, counters: make(map[string]*entry, capacity)}
+}
+
+// add n occurrences of item, with the given error
+func (s *sketch) add(item string, n, err int64) {
+	if e, ok := s.counters[item]; ok {
+		e.Count += n
+		e.Error += err
+		heap.Fix(&s.byCount, e.index)
+		return
+	}
+
+	if len(s.byCount) < s.capacity {
+		e := &entry{Counter: Counter{Item: item, Count: n, Error: err}}
+		s.counters[item] = e
+		heap.Push(&s.byCount, e)
+		return
+	}
+
+	// Replace the least counted item
+	e := s.byCount[0]
+	delete(s.counters, e.Item)
+	e.Item, e.Error = item, e.Count+err
+	e.Count += n
+	s.counters[item] = e
+	heap.Fix(&s.byCount, 0)
+}
+
+// top returns the k counters with the highest count, then by item
+func (s *sketch) top(k int) []Counter {
+	res := make([]Counter, len(s.byCount))
+	for i, e := range s.byCount {
+		res[i] = e.Counter
+	}
+	sort.Sort(byCount(res))
+	if len(res) > k {
+		res = res[:k]
+	}
+	return res
+}
+
+// byCount sorts counters by count (descending), then item
+type byCount []Counter
+
+func (s byCount) Len() int      { return len(s) }
+func (s byCount) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byCount) Less(i, j int) bool {
+	if s[i].Count != s[j].Count {
+		return s[i].Count > s[j].Count
+	}
+	return s[i].Item < s[j].Item
+}
+
+// sketchSlot holds the occurrences during a slot of a window
+type sketchSlot struct {
+	start  time.Time
+	sketch *sketch
+}
+
+// window keeps a sketch per slot of a sliding time window, slots are
+// recycled as time passes so old occurrences are forgotten
+type window struct {
+	slot     time.Duration
+	capacity int
+	slots    []sketchSlot
+}
+
+func newWindow(slot time.Duration, slots, capacity int) *window {
+	return &window{slot: slot, capacity: capacity, slots: make([]sketchSlot, slots)}
+}
+
+// add n occurrences of item at the given time
+func (w *window) add(now time.Time, item string, n int64) {
+	start := now.Truncate(w.slot)
+	s := &w.slots[(start.UnixNano()/int64(w.slot))%int64(len(w.slots))]
+	if s.sketch == nil || !s.start.Equal(start) {
+		*s = sketchSlot{start: start, sketch: newSketch(w.capacity)}
+	}
+	s.sketch.add(item, n, 0)
+}
+
+// last returns the sketch of the given duration (up to the whole window)
+// before now, merging its slots. Items evicted from some slots are
+// undercounted by at most the lowest count of those slots
+func (w *window) last(now time.Time, d time.Duration) *sketch {
+	from := now.Truncate(w.slot).Add(-d + w.slot)
+	merged := newSketch(w.capacity)
+	for i := range w.slots {
+		s := &w.slots[i]
+		if s.sketch == nil || s.start.Before(from) || s.start.After(now) {
+			continue
+		}
+		for _, e := range s.sketch.byCount {
+			merged.add(e.Item, e.Count, e.Error)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,120 @@
+package topk
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/redis.v3"
+)
+
+// Store saves snapshots of the top K, see NewStore. Stores implementing
+// io.Closer are closed with the processor
+type Store interface {
+	Save(s Snapshot) error
+}
+
+// DefaultRedisKey snapshots are saved to by RedisStore
+const DefaultRedisKey = "metrics:topk"
+
+// NewStore returns the store for the given URL, nil for `none`:
+//
+//	file:///var/lib/metrics/topk.json
+//	redis://localhost:6379/metrics:topk
+func NewStore(storeURL string) (Store, error) {
+	if storeURL == "none" {
+		return nil, nil
+	}
+	u, err := url.Parse(storeURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "file":
+		if u.Path == "" {
+			return nil, fmt.Errorf("Missing path in store '%s'", storeURL)
+		}
+		return FileStore{Path: u.Path}, nil
+	case "redis":
+		key := strings.TrimPrefix(u.Path, "/")
+		if key == "" {
+			key = DefaultRedisKey
+		}
+		store, err := NewRedisStore(u.Host, key)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("Unknown store '%s', expected none, file:// or redis://", storeURL)
+	}
+}
+
+// FileStore writes the latest snapshot as JSON to a file, replacing it
+// atomically
+type FileStore struct {
+	Path string
+}
+
+// Save the snapshot, see Store
+func (f FileStore) Save(s Snapshot) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.Path), filepath.Base(f.Path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.Path)
+}
+
+// RedisStore sets the latest snapshot as JSON in a Redis key
+type RedisStore struct {
+	client *redis.Client
+	key    string
+}
+
+// NewRedisStore connects to the given Redis server
+func NewRedisStore(addr, key string) (*RedisStore, error) {
+	log.Debugf("Connecting to Redis (%s)", addr)
+	client := redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: "",
+		DB:       0,
+	})
+
+	if err := client.Ping().Err(); err != nil {
+		log.Errorf("Error connecting to Redis: %s", err)
+		return nil, err
+	}
+	return &RedisStore{client: client, key: key}, nil
+}
+
+// Save the snapshot, see Store
+func (r *RedisStore) Save(s Snapshot) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(r.key, string(data), 0).Err()
+}
+
+// Close the Redis client
+func (r *RedisStore) Close() error {
+	return r.client.Close()
+}
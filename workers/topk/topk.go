@@ -0,0 +1,267 @@
+package topk
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/exekias/metric-collector/logging"
+	"github.com/exekias/metric-collector/queue"
+)
+
+var log = logging.MustGetLogger("topk")
+
+// Defaults of Options
+const (
+	DefaultK                = 10
+	DefaultWindows          = "1m,5m,1h"
+	DefaultSlot             = 10 * time.Second
+	DefaultSnapshotInterval = time.Minute
+
+	// capacityFactor of the sketches, they keep K times this counters so the
+	// top K are accurate
+	capacityFactor = 10
+)
+
+// TopK worker keeps the K usernames and (username, metric) pairs with most
+// metrics over sliding windows, in memory. Counts are estimated with
+// Space-Saving sketches, so it can spot noisy accounts in real time with
+// bounded memory. The current top K is periodically saved to a Store
+type TopK struct {
+	mu      sync.Mutex
+	k       int
+	windows []time.Duration
+	longest time.Duration
+	users   *window
+	pairs   *window
+
+	store    Store
+	interval time.Duration
+	quit     chan struct{}
+	done     chan struct{}
+}
+
+// Options for TopK
+type Options struct {
+	// K items reported, DefaultK if 0
+	K int
+
+	// Windows reported, the longest one is kept in memory. 1m, 5m and 1h
+	// if empty
+	Windows []time.Duration
+
+	// Slot windows are split in, occurrences are forgotten a slot at a time.
+	// DefaultSlot if 0
+	Slot time.Duration
+
+	// Store snapshots are saved to every SnapshotInterval, none if nil
+	Store            Store
+	SnapshotInterval time.Duration
+}
+
+func (o Options) withDefaults() Options {
+	if o.K == 0 {
+		o.K = DefaultK
+	}
+	if len(o.Windows) == 0 {
+		o.Windows, _ = ParseWindows(DefaultWindows)
+	}
+	if o.Slot == 0 {
+		o.Slot = DefaultSlot
+	}
+	if o.SnapshotInterval == 0 {
+		o.SnapshotInterval = DefaultSnapshotInterval
+	}
+	return o
+}
+
+// ParseWindows parses a comma separated list of durations, ie. `1m,5m,1h`
+func ParseWindows(s string) ([]time.Duration, error) {
+	var windows []time.Duration
+	for _, w := range strings.Split(s, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(w))
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("Invalid window '%s', it must be positive", w)
+		}
+		windows = append(windows, d)
+	}
+	return windows, nil
+}
+
+// NewTopK intializes and returns a new top K processor
+func NewTopK(opts Options) *TopK {
+	opts = opts.withDefaults()
+	longest := opts.Slot
+	for _, w := range opts.Windows {
+		if w > longest {
+			longest = w
+		}
+	}
+	// One more slot than needed, the current one is partial
+	slots := int((longest+opts.Slot-1)/opts.Slot) + 1
+	capacity := opts.K * capacityFactor
+
+	processor := &TopK{
+		k:        opts.K,
+		windows:  opts.Windows,
+		longest:  longest,
+		users:    newWindow(opts.Slot, slots, capacity),
+		pairs:    newWindow(opts.Slot, slots, capacity),
+		store:    opts.Store,
+		interval: opts.SnapshotInterval,
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go processor.runSnapshots()
+	return processor
+}
+
+// Process data from the queue, counted at its event time. Metrics older
+// than the longest window are dropped, ie. those queued before starting
+func (p *TopK) Process(d queue.MetricData) error {
+	p.add(time.Now(), d.EventTime(), &d)
+	return nil
+}
+
+// add a metric sent at t, times after now are counted now
+func (p *TopK) add(now, t time.Time, d *queue.MetricData) {
+	if t.After(now) {
+		t = now
+	}
+	if !t.After(now.Add(-p.longest)) {
+		log.Debugf("Dropping metric sent at %s, older than the longest window", t)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.users.add(t, d.Username, 1)
+	p.pairs.add(t, pairKey(d.Username, d.Metric), 1)
+}
+
+// pairKey of a username and metric in the pairs sketches
+func pairKey(username, metric string) string {
+	return username + "\x00" + metric
+}
+
+// UserCount is the estimated number of metrics sent by a user, Count
+// overestimates it by at most Error
+type UserCount struct {
+	Username string `json:"username"`
+	Count    int64  `json:"count"`
+	Error    int64  `json:"error"`
+}
+
+// PairCount is the estimated number of times a user sent a metric, Count
+// overestimates it by at most Error
+type PairCount struct {
+	Username string `json:"username"`
+	Metric   string `json:"metric"`
+	Count    int64  `json:"count"`
+	Error    int64  `json:"error"`
+}
+
+// WindowTop is the top K of a window
+type WindowTop struct {
+	Window string      `json:"window"`
+	Users  []UserCount `json:"users"`
+	Pairs  []PairCount `json:"pairs"`
+}
+
+// Snapshot of the top K of every window
+type Snapshot struct {
+	Time    time.Time   `json:"time"`
+	Windows []WindowTop `json:"windows"`
+}
+
+// Snapshot returns the current top K of every window
+func (p *TopK) Snapshot() Snapshot {
+	return p.snapshot(time.Now())
+}
+
+func (p *TopK) snapshot(now time.Time) Snapshot {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := Snapshot{Time: now.UTC()}
+	for _, w := range p.windows {
+		top := WindowTop{Window: w.String(), Users: []UserCount{}, Pairs: []PairCount{}}
+		for _, c := range p.users.last(now, w).top(p.k) {
+			top.Users = append(top.Users, UserCount{Username: c.Item, Count: c.Count, Error: c.Error})
+		}
+		for _, c := range p.pairs.last(now, w).top(p.k) {
+			parts := strings.SplitN(c.Item, "\x00", 2)
+			top.Pairs = append(top.Pairs, PairCount{Username: parts[0], Metric: parts[1], Count: c.Count, Error: c.Error})
+		}
+		s.Windows = append(s.Windows, top)
+	}
+	return s
+}
+
+// Handler serves the current top K as JSON, only that of the given window
+// if any (ie. ?window=5m)
+func (p *TopK) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := p.Snapshot()
+		if name := r.FormValue("window"); name != "" {
+			d, err := time.ParseDuration(name)
+			windows := s.Windows
+			s.Windows = nil
+			for _, top := range windows {
+				if err == nil && top.Window == d.String() {
+					s.Windows = append(s.Windows, top)
+				}
+			}
+			if s.Windows == nil {
+				http.Error(w, "Unknown window '"+name+"'", http.StatusNotFound)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+	})
+}
+
+// runSnapshots saves a snapshot to the store every interval, until closed
+func (p *TopK) runSnapshots() {
+	defer close(p.done)
+	if p.store == nil {
+		<-p.quit
+		return
+	}
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.save()
+		case <-p.quit:
+			p.save()
+			return
+		}
+	}
+}
+
+func (p *TopK) save() {
+	if err := p.store.Save(p.Snapshot()); err != nil {
+		log.Errorf("Error saving top K snapshot: %s", err)
+	}
+}
+
+// Close saves a last snapshot and closes the store
+func (p *TopK) Close() error {
+	close(p.quit)
+	<-p.done
+	if closer, ok := p.store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
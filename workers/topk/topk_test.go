@@ -0,0 +1,153 @@
+package topk
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/exekias/metric-collector/queue"
+)
+
+func TestSketch(t *testing.T) {
+	// 3 heavy hitters among many one-off items, with ~1550 occurrences in
+	// total a capacity of 50 overestimates them by at most 31
+	s := newSketch(50)
+	for i := 0; i < 1000; i++ {
+		s.add(fmt.Sprintf("item%d", i), 1, 0)
+		if i%4 == 0 {
+			s.add("heavy1", 1, 0)
+		}
+		if i%5 == 0 {
+			s.add("heavy2", 1, 0)
+		}
+		if i%10 == 0 {
+			s.add("heavy3", 1, 0)
+		}
+	}
+
+	top := s.top(3)
+	expected := []struct {
+		item  string
+		count int64
+	}{{"heavy1", 250}, {"heavy2", 200}, {"heavy3", 100}}
+	for i, e := range expected {
+		c := top[i]
+		if c.Item != e.item || c.Count < e.count || c.Count-c.Error > e.count {
+			t.Errorf("Expected %s with %d occurrences, got %+v", e.item, e.count, c)
+		}
+	}
+	if len(s.counters) != 50 || len(s.byCount) != 50 {
+		t.Errorf("Sketch over capacity: %d counters", len(s.counters))
+	}
+}
+
+func TestWindow(t *testing.T) {
+	w := newWindow(10*time.Second, 7, 10)
+	now := time.Date(2016, 5, 4, 10, 0, 0, 0, time.UTC)
+	w.add(now, "old", 5)
+	w.add(now.Add(50*time.Second), "new", 1)
+	w.add(now.Add(55*time.Second), "new", 2)
+
+	later := now.Add(55 * time.Second)
+	if top := w.last(later, time.Minute).top(10); len(top) != 2 || top[0].Item != "old" || top[1].Count != 3 {
+		t.Errorf("Unexpected top of the last minute %+v", top)
+	}
+	if top := w.last(later, 10*time.Second).top(10); len(top) != 1 || top[0].Item != "new" {
+		t.Errorf("Unexpected top of the last 10s %+v", top)
+	}
+
+	// The slot of "old" is recycled
+	w.add(now.Add(70*time.Second), "newer", 1)
+	if top := w.last(now.Add(70*time.Second), time.Minute).top(10); len(top) != 2 || top[0].Item != "new" {
+		t.Errorf("Expected old metrics to be forgotten, got %+v", top)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "topk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "topk.json")
+
+	windows, _ := ParseWindows("1m,5m")
+	p := NewTopK(Options{K: 2, Windows: windows, Store: FileStore{Path: path}})
+	now := time.Now()
+	for _, d := range []queue.MetricData{
+		{Username: "user1", Metric: "metric1"},
+		{Username: "user1", Metric: "metric1"},
+		{Username: "user1", Metric: "metric2"},
+		{Username: "user2", Metric: "metric1"},
+		{Username: "user3", Metric: "metric1"},
+		{Username: "user3", Metric: "metric1"},
+	} {
+		p.add(now, now.Add(-time.Second), &d)
+	}
+	// Metrics older than the longest window are dropped, future ones
+	// counted now
+	p.add(now, now.Add(-5*time.Minute), &queue.MetricData{Username: "user2", Metric: "metric1"})
+	p.add(now, now.Add(time.Hour), &queue.MetricData{Username: "user1", Metric: "metric2"})
+
+	s := p.snapshot(now)
+	if len(s.Windows) != 2 || s.Windows[0].Window != "1m0s" {
+		t.Fatalf("Unexpected windows %+v", s.Windows)
+	}
+	top := s.Windows[0]
+	if len(top.Users) != 2 || top.Users[0] != (UserCount{Username: "user1", Count: 4}) || top.Users[1].Username != "user3" {
+		t.Errorf("Unexpected top users %+v", top.Users)
+	}
+	if len(top.Pairs) != 2 || top.Pairs[0] != (PairCount{Username: "user1", Metric: "metric1", Count: 2}) {
+		t.Errorf("Unexpected top pairs %+v", top.Pairs)
+	}
+
+	rec := httptest.NewRecorder()
+	p.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/topk?window=5m", nil))
+	var served Snapshot
+	if err := json.Unmarshal(rec.Body.Bytes(), &served); err != nil {
+		t.Fatal(err)
+	}
+	if len(served.Windows) != 1 || served.Windows[0].Window != "5m0s" {
+		t.Errorf("Expected only the 5m window, got %s", rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	p.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/topk?window=2m", nil))
+	if rec.Code != 404 {
+		t.Errorf("Expected 404 for an unknown window, got %d", rec.Code)
+	}
+
+	// Closing saves a last snapshot
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved Snapshot
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Windows) != 2 || saved.Windows[0].Users[0].Username != "user1" {
+		t.Errorf("Unexpected snapshot saved %s", data)
+	}
+}
+
+func TestNewStore(t *testing.T) {
+	if store, err := NewStore("none"); store != nil || err != nil {
+		t.Errorf("Expected no store, got %v %v", store, err)
+	}
+	if store, err := NewStore("file:///tmp/topk.json"); err != nil || store != (FileStore{Path: "/tmp/topk.json"}) {
+		t.Errorf("Unexpected file store %v %v", store, err)
+	}
+	for _, s := range []string{"file://", "s3://bucket/topk.json"} {
+		if _, err := NewStore(s); err == nil {
+			t.Errorf("Expected an error for store '%s'", s)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package workers
+
+import "time"
+
+// latencyBuckets upper bounds in seconds, latencies above the last one are
+// counted in an extra overflow bucket
+var latencyBuckets = [...]float64{
+	0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+// histogram of latencies, using latencyBuckets
+type histogram struct {
+	Buckets [len(latencyBuckets) + 1]int64 // last one is the overflow
+	Count   int64
+	Sum     float64
+}
+
+func (h *histogram) observe(seconds float64) {
+	i := 0
+	for i < len(latencyBuckets) && seconds > latencyBuckets[i] {
+		i++
+	}
+	h.Buckets[i]++
+	h.Count++
+	h.Sum += seconds
+}
+
+func (h *histogram) merge(o *histogram) {
+	for i := range h.Buckets {
+		h.Buckets[i] += o.Buckets[i]
+	}
+	h.Count += o.Count
+	h.Sum += o.Sum
+}
+
+// percentile estimates the given percentile (0-1) in seconds, interpolating
+// inside the bucket it falls in
+func (h *histogram) percentile(p float64) float64 {
+	if h.Count == 0 {
+		return 0
+	}
+
+	rank := p * float64(h.Count)
+	var seen float64
+	for i, n := range h.Buckets {
+		if n == 0 || seen+float64(n) < rank {
+			seen += float64(n)
+			continue
+		}
+		if i == len(latencyBuckets) {
+			// Overflow, we don't know better
+			return latencyBuckets[i-1]
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = latencyBuckets[i-1]
+		}
+		return lower + (latencyBuckets[i]-lower)*(rank-seen)/float64(n)
+	}
+	return latencyBuckets[len(latencyBuckets)-1]
+}
+
+// windowSlot holds the results during a slot of a window
+type windowSlot struct {
+	start   time.Time
+	errors  int64
+	latency histogram
+}
+
+// window keeps results over a sliding time window, split in slots which are
+// recycled as time passes, so old results are forgotten
+type window struct {
+	slot  time.Duration
+	slots []windowSlot
+}
+
+func newWindow(slot time.Duration, slots int) *window {
+	return &window{slot: slot, slots: make([]windowSlot, slots)}
+}
+
+// observe a result at the given time
+func (w *window) observe(now time.Time, seconds float64, failed bool) {
+	start := now.Truncate(w.slot)
+	s := &w.slots[(start.UnixNano()/int64(w.slot))%int64(len(w.slots))]
+	if !s.start.Equal(start) {
+		*s = windowSlot{start: start}
+	}
+	s.latency.observe(seconds)
+	if failed {
+		s.errors++
+	}
+}
+
+// last returns the merged results of the given duration (up to the whole
+// window) before now
+func (w *window) last(now time.Time, d time.Duration) (h histogram, errors int64) {
+	from := now.Truncate(w.slot).Add(-d + w.slot)
+	for i := range w.slots {
+		s := &w.slots[i]
+		if s.start.IsZero() || s.start.Before(from) || s.start.After(now) {
+			continue
+		}
+		h.merge(&s.latency)
+		errors += s.errors
+	}
+	return h, errors
+}
+
+// rate returns results per second during the given duration before now
+func (w *window) rate(now time.Time, d time.Duration) float64 {
+	h, _ := w.last(now, d)
+	return float64(h.Count) / d.Seconds()
+}
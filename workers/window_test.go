@@ -0,0 +1,50 @@
+package workers
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestHistogramPercentile(t *testing.T) {
+	var h histogram
+	for i := 0; i < 90; i++ {
+		h.observe(0.002) // (0.001, 0.0025]
+	}
+	for i := 0; i < 10; i++ {
+		h.observe(0.2) // (0.1, 0.25]
+	}
+
+	if p := h.percentile(0.5); p <= 0.001 || p > 0.0025 {
+		t.Errorf("Expected p50 in (0.001, 0.0025], got %f", p)
+	}
+	if p := h.percentile(0.99); p <= 0.1 || p > 0.25 {
+		t.Errorf("Expected p99 in (0.1, 0.25], got %f", p)
+	}
+
+	h.observe(60)
+	if p := h.percentile(1); p != 10 {
+		t.Errorf("Expected overflow percentile to be the last bucket, got %f", p)
+	}
+}
+
+func TestWindowForgetsOldResults(t *testing.T) {
+	w := newWindow(10*time.Second, 6)
+	now := time.Unix(1000000, 0)
+
+	w.observe(now.Add(-2*time.Minute), 5, true)
+	for i := 0; i < 30; i++ {
+		w.observe(now.Add(-time.Duration(i)*time.Second), 0.001, false)
+	}
+
+	h, errors := w.last(now, time.Minute)
+	if h.Count != 30 || errors != 0 {
+		t.Errorf("Expected 30 results and no errors in the last minute, got %d and %d", h.Count, errors)
+	}
+	if p := h.percentile(0.99); p > 0.001 {
+		t.Errorf("Old latencies should be forgotten, got p99 %f", p)
+	}
+	if r := w.rate(now, time.Minute); math.Abs(r-0.5) > 1e-9 {
+		t.Errorf("Expected 0.5 metrics per second, got %f", r)
+	}
+}
@@ -1,7 +1,9 @@
 package workers
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"time"
 
 	"github.com/exekias/metric-collector/logging"
 	"github.com/exekias/metric-collector/queue"
@@ -9,66 +11,176 @@ import (
 
 var log = logging.MustGetLogger("worker")
 
-// RunWorker listen for messages in the given channel and process trough the given processor
-func RunWorker(channel queue.Channel, q string, processor MetricDataProcessor) {
+// Options for RunWorker
+type Options struct {
+	// DrainTimeout is the time in-flight metrics are given to finish on
+	// shutdown before being requeued
+	DrainTimeout time.Duration
 
-	// Listen in the queue
-	metrics, err := channel.ConsumeMetrics(q)
+	// MaxAttempts to process a metric before sending it to the dead-letter
+	// queue, 0 means retry forever
+	MaxAttempts int
+
+	// Concurrency is the number of metrics processed at the same time, also
+	// used as the queue prefetch. 0 uses the processor hint (see
+	// ConcurrencyHinter) or DefaultConcurrency
+	Concurrency int
+
+	// Breaker options, consumption is paused while the processor is failing
+	Breaker BreakerOptions
+
+	// Name of the processor, added to log messages
+	Name string
+}
+
+// DefaultOptions for RunWorker
+var DefaultOptions = Options{
+	DrainTimeout: 30 * time.Second,
+	MaxAttempts:  5,
+	Breaker:      DefaultBreakerOptions,
+}
+
+// DefaultConcurrency used when neither the options nor the processor set one
+const DefaultConcurrency = 3
+
+// ErrDisconnected is returned when the metrics queue is closed
+var ErrDisconnected = errors.New("Disconnected from metrics queue")
+
+// RunWorker listen for messages in the given channel and process trough the
+// given processor until ctx is done, using a pool of opts.Concurrency
+// goroutines. When the processor keeps failing consumption is paused, see
+// BreakerOptions. On return no more metrics are consumed, in-flight ones are
+// given opts.DrainTimeout to finish and requeued otherwise.
+// Closing the channel and the processor is up to the caller.
+func RunWorker(ctx context.Context, channel queue.Channel, q string, processor MetricDataProcessor, opts Options) error {
+	size := concurrency(processor, opts)
+
+	// Listen in the queue, prefetching as many metrics as we can process
+	// at once, so the broker keeps the rest for other workers
+	metrics, err := channel.ConsumeMetrics(q, size)
 	if err != nil {
-		log.Fatal("Could not consume from queue", err)
+		return err
 	}
 
-	// Results channel, true = success, false = error
-	results := make(chan bool)
+	// Stop consuming while the processor keeps failing
+	circuit := newBreaker(q, opts.Breaker)
 
-	// Will get true when too many errors happened
-	tooManyErrors := make(chan bool)
+	// Start the pool
+	log.Infof("Processing up to %d metrics at a time", size)
+	observePoolSize(processor, size)
+	pending := newInflight(q)
+	jobs := make(chan *delivery)
+	logger := log.With(logging.Fields{"queue": q})
+	if opts.Name != "" {
+		logger = logger.With(logging.Fields{"processor": opts.Name})
+	}
+	for i := 0; i < size; i++ {
+		go func() {
+			for d := range jobs {
+				observeStart(processor, time.Since(d.received))
+				l := logger
+				if tag, ok := deliveryTag(d.MetricMessage); ok {
+					l = l.With(logging.Fields{"delivery_tag": tag})
+				}
+				process(d, processor, opts.MaxAttempts, circuit, l)
+				observeDone(processor)
+				pending.done(d)
+			}
+		}()
+	}
 
-	go errorCheck(results, tooManyErrors)
+	// Listen and dispatch all metrics
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			log.Info("Shutting down, no longer consuming metrics")
+			break loop
 
-	// Listen and process all metrics
-	for metric := range metrics {
-		// Process in a goroutine, channel QoS will handle throttling,
-		// see queue/rabbitmq.go:ConsumeMetrics
-		go func(m queue.MetricMessage, results chan<- bool) {
-			data, err := m.MetricData()
-			if err != nil {
-				log.Error("Unexpected error reading metric data:", err)
-			}
-			log.Debug(fmt.Sprintf("Processing metric %#v", data))
-			if err := processor.Process(data); err == nil {
-				// We are done
-				m.Ack()
-				results <- true
-			} else {
-				log.Warning("Error while processing a metric, won't ACK:", err)
-				m.Nack()
-				results <- false
+		case metric, ok := <-metrics:
+			if !ok {
+				err = ErrDisconnected
+				break loop
 			}
-		}(metric, results)
 
-		select {
-		case <-tooManyErrors:
-			log.Error("Processor had too many errors, quitting...")
-			return
-		default:
+			// Wait for the breaker and a free goroutine, giving the metric
+			// back if we stop
+			d := pending.add(metric)
+			if trial, ok := circuit.wait(ctx); ok {
+				d.trial = trial
+				select {
+				case jobs <- d:
+					continue
+				case <-ctx.Done():
+				}
+			}
+			log.Info("Shutting down, no longer consuming metrics")
+			d.Requeue()
+			pending.done(d)
+			break loop
 		}
 	}
-	log.Error("Disconnected from metrics queue")
+
+	close(jobs)
+	pending.drain(opts.DrainTimeout)
+	return err
 }
 
-// errorCheck notifies of too many errors after 5 errors in a row
-func errorCheck(results <-chan bool, tooManyErrors chan<- bool) {
-	errors := 0
-	for success := range results {
-		if success {
-			errors = 0
-		} else {
-			errors++
+// concurrency returns the pool size for the given processor and options
+func concurrency(p MetricDataProcessor, opts Options) int {
+	if opts.Concurrency > 0 {
+		return opts.Concurrency
+	}
+	if hint := concurrencyHint(p); hint > 0 {
+		return hint
+	}
+	return DefaultConcurrency
+}
+
+// process a single message, feeding the result to circuit. Invalid messages
+// are rejected right away, without a result. Failed messages are requeued
+// until maxAttempts is reached, then rejected, but those failing during an
+// outage are requeued without spending an attempt
+func process(d *delivery, processor MetricDataProcessor, maxAttempts int, circuit *breaker, log *logging.Logger) {
+	data, err := d.MetricData()
+	if err == nil {
+		err = data.Validate()
+	}
+	if err != nil {
+		// Retrying won't help, send it to the dead-letter queue
+		log.Errorf("Invalid metric, sending it to the dead-letter queue: %s", err)
+		countInvalid(processor)
+		if err := d.Reject(); err != nil {
+			log.Errorf("Could not reject metric: %s", err)
 		}
+		// Not a processor error, it can't decide a trial either
+		circuit.release(d.trial)
+		return
+	}
 
-		if errors >= 5 {
-			tooManyErrors <- true
+	log = log.With(logging.Fields{"metric": data.Metric, "username": data.Username})
+	log.Debugf("Processing metric %#v", data)
+	start := time.Now()
+	err = processor.Process(data)
+	log = log.With(logging.Fields{"latency": time.Since(start).Seconds()})
+	if err != nil {
+		if circuit.record(d.trial, false) {
+			log.Warningf("Error while processing a metric during an outage, requeuing it: %s", err)
+			d.Requeue()
+		} else if maxAttempts > 0 && d.Attempts() >= maxAttempts {
+			log.Errorf("Error while processing a metric after %d attempts, sending it to the dead-letter queue: %s", d.Attempts(), err)
+			if err := d.Reject(); err != nil {
+				log.Errorf("Could not reject metric: %s", err)
+			}
+		} else {
+			log.Warningf("Error while processing a metric, won't ACK: %s", err)
+			d.Nack()
 		}
+		return
 	}
+
+	// We are done
+	circuit.record(d.trial, true)
+	d.Ack()
+	log.Debug("Metric processed")
 }
@@ -1,6 +1,8 @@
 package workers
 
 import (
+	"context"
+	"errors"
 	"testing"
 	"time"
 
@@ -19,16 +21,16 @@ func (c Debug) Process(data queue.MetricData) error {
 
 func TestRunWorkerCallsProcess(t *testing.T) {
 	channel := queue.Dummy()
-	channel.DeclareExchange("foo", true)
+	channel.DeclareExchange("foo", queue.Fanout, true)
 	channel.DeclareQueue("foo", "bar", true)
-	debug := Debug{processed: make(chan queue.MetricData, 0)}
+	debug := Debug{processed: make(chan queue.MetricData, 1)}
 
 	go func() {
-		channel.PublishMetric("foo", &queue.MetricData{"user", 0, "sample_metric"})
+		channel.PublishMetric("foo", &queue.MetricData{Username: "user", Count: 0, Metric: "sample_metric"})
 		channel.Close()
 	}()
 
-	RunWorker(channel, "bar", debug)
+	RunWorker(context.Background(), channel, "bar", debug, DefaultOptions)
 
 	select {
 	case <-debug.processed:
@@ -37,3 +39,218 @@ func TestRunWorkerCallsProcess(t *testing.T) {
 		t.Error("Data sent trough the queue was not processed")
 	}
 }
+
+// Helper processor blocking until released
+type Blocking struct {
+	started chan bool
+	release chan bool
+}
+
+func (b Blocking) Process(data queue.MetricData) error {
+	b.started <- true
+	<-b.release
+	return nil
+}
+
+func TestRunWorkerStopsOnContextDone(t *testing.T) {
+	channel := queue.Dummy()
+	channel.DeclareExchange("foo", queue.Fanout, true)
+	channel.DeclareQueue("foo", "bar", true)
+	debug := Debug{processed: make(chan queue.MetricData, 1)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- RunWorker(ctx, channel, "bar", debug, DefaultOptions)
+	}()
+
+	channel.PublishMetric("foo", &queue.MetricData{Username: "user", Metric: "sample_metric"})
+	<-debug.processed
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected clean shutdown, got %s", err)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Error("Worker did not stop after context was cancelled")
+	}
+}
+
+func TestRunWorkerRequeuesAfterDrainTimeout(t *testing.T) {
+	channel := queue.Dummy()
+	channel.DeclareExchange("foo", queue.Fanout, true)
+	channel.DeclareQueue("foo", "bar", true)
+	blocking := Blocking{started: make(chan bool), release: make(chan bool)}
+	defer close(blocking.release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- RunWorker(ctx, channel, "bar", blocking, Options{DrainTimeout: 50 * time.Millisecond})
+	}()
+
+	m := queue.NewDummyMetricMessage(queue.MetricData{Username: "user", Metric: "sample_metric"})
+	channel.Deliver("bar", m)
+	<-blocking.started
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Worker did not give up draining after timeout")
+	}
+
+	if !m.Requeued || m.Nacked || m.Acked {
+		t.Error("In-flight metric should have been requeued without spending an attempt")
+	}
+}
+
+// Helper processor always failing
+type Failing struct{}
+
+func (f Failing) Process(data queue.MetricData) error {
+	return errors.New("failed")
+}
+
+func TestProcessRequeuesDuringOutage(t *testing.T) {
+	data := queue.MetricData{Username: "user", Metric: "sample_metric"}
+
+	// Failing while opening the breaker doesn't spend an attempt
+	m := queue.NewDummyMetricMessage(data)
+	process(&delivery{MetricMessage: m}, Failing{}, 1, newBreaker("test_outage", BreakerOptions{Window: 1}), log)
+	if !m.Requeued || m.Nacked || m.Rejected {
+		t.Errorf("Expected the metric requeued as is, got %+v", m)
+	}
+
+	m = queue.NewDummyMetricMessage(data)
+	process(&delivery{MetricMessage: m}, Failing{}, 1, newBreaker("test_failure", BreakerOptions{}), log)
+	if !m.Rejected || m.Requeued {
+		t.Errorf("Expected the metric dead-lettered after its last attempt, got %+v", m)
+	}
+}
+
+func TestProcessInvalidTrial(t *testing.T) {
+	b := newBreaker("test_invalid_trial", BreakerOptions{Window: 1, OpenTimeout: time.Millisecond})
+	b.record(false, false)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	trial, ok := b.wait(ctx)
+	if !ok || !trial {
+		t.Fatal("Breaker did not let a trial metric trough")
+	}
+
+	// An invalid trial doesn't close the breaker, the next metric is the trial
+	m := queue.NewDummyMetricMessage(queue.MetricData{Metric: "sample_metric"})
+	process(&delivery{MetricMessage: m, trial: true}, Failing{}, 1, b, log)
+	if !m.Rejected {
+		t.Error("Expected the invalid metric dead-lettered")
+	}
+	if b.State() != BreakerHalfOpen {
+		t.Errorf("Breaker should stay half-open, got %s", b.State())
+	}
+	if trial, ok := b.wait(ctx); !ok || !trial {
+		t.Error("Breaker did not let the next metric trough as trial")
+	}
+}
+
+func TestRunWorkerDeadLettersAfterMaxAttempts(t *testing.T) {
+	channel := queue.Dummy()
+	channel.DeclareExchange("foo", queue.Fanout, true)
+	channel.DeclareQueue("foo", "bar", true)
+	deadLetters, _ := channel.ConsumeMetrics(queue.DeadLetterQueue("bar"), 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go RunWorker(ctx, channel, "bar", Failing{}, Options{MaxAttempts: 3})
+
+	channel.PublishMetric("foo", &queue.MetricData{Username: "user", Metric: "sample_metric"})
+
+	select {
+	case m := <-deadLetters:
+		if m.Attempts() != 3 {
+			t.Errorf("Expected metric to be dead-lettered after 3 attempts, got %d", m.Attempts())
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Error("Failing metric was not dead-lettered")
+	}
+}
+
+func TestRunWorkerDeadLettersInvalidMetrics(t *testing.T) {
+	channel := queue.Dummy()
+	channel.DeclareExchange("foo", queue.Fanout, true)
+	channel.DeclareQueue("foo", "bar", true)
+	deadLetters, _ := channel.ConsumeMetrics(queue.DeadLetterQueue("bar"), 1)
+	debug := Debug{processed: make(chan queue.MetricData, 1)}
+	stats := Stats("debug", debug, false).(*StatsProcessor)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go RunWorker(ctx, channel, "bar", stats, DefaultOptions)
+
+	channel.PublishMetric("foo", &queue.MetricData{Username: "", Metric: "sample_metric"})
+
+	select {
+	case <-deadLetters:
+	case <-debug.processed:
+		t.Fatal("Invalid metric was processed")
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Invalid metric was not dead-lettered")
+	}
+
+	stats.Lock()
+	defer stats.Unlock()
+	if stats.NumInvalid != 1 {
+		t.Errorf("Expected 1 invalid metric, got %d", stats.NumInvalid)
+	}
+}
+
+// Helper processor with a concurrency hint
+type Hinted struct {
+	Blocking
+	hint int
+}
+
+func (h Hinted) Concurrency() int {
+	return h.hint
+}
+
+func TestRunWorkerBoundsConcurrency(t *testing.T) {
+	channel := queue.Dummy()
+	channel.DeclareExchange("foo", queue.Fanout, true)
+	channel.DeclareQueue("foo", "bar", true)
+	hinted := Hinted{Blocking{started: make(chan bool, 10), release: make(chan bool)}, 2}
+	stats := Stats("hinted", hinted, false).(*StatsProcessor)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go RunWorker(ctx, channel, "bar", stats, Options{DrainTimeout: time.Second})
+
+	for i := 0; i < 5; i++ {
+		channel.PublishMetric("foo", &queue.MetricData{Username: "user", Metric: "sample_metric"})
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-hinted.started:
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("Metrics were not processed")
+		}
+	}
+	select {
+	case <-hinted.started:
+		t.Fatal("More metrics than the pool size were processed at once")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	stats.Lock()
+	if stats.PoolSize != 2 || stats.PoolBusy != 2 {
+		t.Errorf("Expected a pool of 2 busy goroutines, got %d/%d", stats.PoolBusy, stats.PoolSize)
+	}
+	stats.Unlock()
+
+	for i := 0; i < 5; i++ {
+		hinted.release <- true
+	}
+}